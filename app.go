@@ -1,15 +1,22 @@
 package senpai
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"git.sr.ht/~taiite/senpai/irc"
 	"git.sr.ht/~taiite/senpai/ui"
@@ -24,38 +31,88 @@ func isCommand(input []rune) bool {
 	return len(input) >= 1 && input[0] == '/' && !(len(input) >= 2 && input[1] == '/')
 }
 
+// maxBoundIDs is the number of line IDs remembered per buffer, past which the
+// oldest half is forgotten.
+const maxBoundIDs = 4096
+
 type bound struct {
 	first time.Time
 	last  time.Time
 
 	firstMessage string
 	lastMessage  string
+
+	ids       map[string]time.Time // the IDs of the lines added, and their time.
+	idsBefore time.Time            // the IDs of the lines before this are forgotten.
 }
 
 // Compare returns 0 if line is within bounds, -1 if before, 1 if after.
+//
+// Lines with an ID are within bounds if a line with the same ID has been
+// added, or if they are strictly between the first and last lines.  Others
+// are compared by time, truncated to the second, and content.  Has tells
+// whether lines within bounds have already been added.
 func (b *bound) Compare(line *ui.Line) int {
+	if line.ID != "" {
+		if _, ok := b.ids[line.ID]; ok {
+			return 0
+		}
+		if line.At.Before(b.first) {
+			return -1
+		}
+		if !line.At.Before(b.last) {
+			return 1
+		}
+		if line.At.Equal(b.first) {
+			return -1
+		}
+		return 0
+	}
+
 	at := line.At.Truncate(time.Second)
-	if at.Before(b.first) {
+	first := b.first.Truncate(time.Second)
+	last := b.last.Truncate(time.Second)
+	if at.Before(first) {
 		return -1
 	}
-	if at.After(b.last) {
+	if at.After(last) {
 		return 1
 	}
-	if at.Equal(b.first) && line.Body.String() != b.firstMessage {
+	if at.Equal(first) && line.Body.String() != b.firstMessage {
 		return -1
 	}
-	if at.Equal(b.last) && line.Body.String() != b.lastMessage {
+	if at.Equal(last) && line.Body.String() != b.lastMessage {
 		return -1
 	}
 	return 0
 }
 
+// Has reports whether line, within bounds, has already been added.  Only
+// lines with an ID can be told apart from the others within bounds, and only
+// if their ID has not been forgotten.
+func (b *bound) Has(line *ui.Line) bool {
+	if line.ID == "" || line.At.Before(b.idsBefore) {
+		return true
+	}
+	_, ok := b.ids[line.ID]
+	return ok
+}
+
 // Update updates the bounds to include the given line.
 func (b *bound) Update(line *ui.Line) {
 	if line.At.IsZero() {
 		return
 	}
-	at := line.At.Truncate(time.Second)
+	if line.ID != "" {
+		if b.ids == nil {
+			b.ids = map[string]time.Time{}
+		}
+		b.ids[line.ID] = line.At
+		if maxBoundIDs < len(b.ids) {
+			b.forgetOldIDs()
+		}
+	}
+	at := line.At
 	if b.first.IsZero() || at.Before(b.first) {
 		b.first = at
 		b.firstMessage = line.Body.String()
@@ -65,6 +122,21 @@ func (b *bound) Update(line *ui.Line) {
 	}
 }
 
+// forgetOldIDs forgets the oldest half of the IDs.
+func (b *bound) forgetOldIDs() {
+	times := make([]time.Time, 0, len(b.ids))
+	for _, at := range b.ids {
+		times = append(times, at)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	b.idsBefore = times[len(times)/2]
+	for id, at := range b.ids {
+		if at.Before(b.idsBefore) {
+			delete(b.ids, id)
+		}
+	}
+}
+
 // IsZero reports whether the bound is empty.
 func (b *bound) IsZero() bool {
 	return b.first.IsZero()
@@ -75,16 +147,35 @@ type event struct {
 	content interface{}
 }
 
+// connection is sent by ircLoop when a new connection has been established.
+type connection struct {
+	session   *irc.Session
+	conn      net.Conn
+	host      string // the host connected to, without the port.
+	port      int
+	tls       bool
+	insecure  bool // whether the server certificate has not been verified.
+	websocket bool // whether STS does not apply, the connection being a WebSocket.
+}
+
 type boundKey struct {
 	netID  string
 	target string
 }
 
 type App struct {
-	win      *ui.UI
-	sessions map[string]*irc.Session
-	pasting  bool
-	events   chan event
+	win         *ui.UI
+	sessions    map[string]*irc.Session
+	connections map[string]connection
+	networks    map[string]NetworkConfig // configuration of each network, by netID.
+	controls    map[string]chan netControl
+	netStates   map[string]netState
+	pasting     bool
+	events      chan event
+
+	stsLock     sync.Mutex     // protects stsPolicies, also used by ircLoop.
+	sending     sync.WaitGroup // counts the connections with messages left to send.
+	stsPolicies map[string]STSPolicy
 
 	cfg        Config
 	highlights []string
@@ -97,14 +188,102 @@ type App struct {
 
 	lastMessageTime time.Time
 	lastCloseTime   time.Time
+
+	lastInput   time.Time           // when a key was last pressed, for auto-away.
+	autoAway    map[string]struct{} // set of networks marked away by auto-away.
+	awayMessage string              // the message of /away, or "" if back.
+
+	list         shownList           // what the list shown in place of the timeline is about.
+	channelLists map[string][]string // channels given by the last /list, by netID.
+}
+
+// shownList describes the list shown in place of the timeline, if any.
+type shownList struct {
+	netID   string
+	channel string // the channel of mode lists.
+	mode    byte   // the channel mode of the entries, such as 'b' for bans, or 0 for the channel list.
+	input   string // the input the list has last been searched with.
+
+	// Conditions of /list the server does not support.
+	minUsers int
+	maxUsers int      // -1 if unbounded.
+	masks    []string // masks channel names must match, or not match if they start with "!".
+}
+
+// matches returns whether the channel fulfills the conditions of the list.
+func (l *shownList) matches(s *irc.Session, c irc.ListedChannel) bool {
+	if c.Users < l.minUsers || (0 <= l.maxUsers && l.maxUsers < c.Users) {
+		return false
+	}
+	name := s.Casemap(c.Name)
+	for _, mask := range l.masks {
+		negated := strings.HasPrefix(mask, "!")
+		mask = s.Casemap(strings.TrimPrefix(mask, "!"))
+		if matchMask(mask, name) == negated {
+			return false
+		}
+	}
+	return true
+}
+
+// matchMask returns whether name matches mask, in which "*" matches any
+// string and "?" any character.
+func matchMask(mask, name string) bool {
+	for mask != "" {
+		switch mask[0] {
+		case '*':
+			for i := len(name); 0 <= i; i-- {
+				if matchMask(mask[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if name == "" {
+				return false
+			}
+			_, n := utf8.DecodeRuneInString(name)
+			name = name[n:]
+		default:
+			if name == "" || name[0] != mask[0] {
+				return false
+			}
+			name = name[1:]
+		}
+		mask = mask[1:]
+	}
+	return name == ""
+}
+
+// channelListTitle returns the title of the list of channels given by /list.
+func channelListTitle(count int, done bool) string {
+	if done {
+		return fmt.Sprintf("Channels (%d)", count)
+	}
+	return fmt.Sprintf("Channels (%d, loading…)", count)
+}
+
+// modeListNames are the names of the channel lists, by mode.
+var modeListNames = map[byte]string{
+	'b': "Bans",
+	'e': "Ban exceptions",
+	'I': "Invite exceptions",
 }
 
 func NewApp(cfg Config) (app *App, err error) {
 	app = &App{
 		sessions:      map[string]*irc.Session{},
+		connections:   map[string]connection{},
+		networks:      map[string]NetworkConfig{},
+		controls:      map[string]chan netControl{},
+		netStates:     map[string]netState{},
+		stsPolicies:   map[string]STSPolicy{},
 		events:        make(chan event, eventChanSize),
 		cfg:           cfg,
 		messageBounds: map[boundKey]bound{},
+		lastInput:     time.Now(),
+		autoAway:      map[string]struct{}{},
+		channelLists:  map[string][]string{},
 	}
 
 	if cfg.Highlights != nil {
@@ -153,6 +332,20 @@ func (app *App) Close() {
 	}
 }
 
+// WaitSent waits for the messages queued for the servers to be sent, such as
+// a paste followed by a QUIT, for at most d.  Call it after Close.
+func (app *App) WaitSent(d time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		app.sending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+	}
+}
+
 func (app *App) SwitchToBuffer(netID, buffer string) {
 	app.lastNetID = netID
 	app.lastBuffer = buffer
@@ -163,7 +356,14 @@ func (app *App) Run() {
 		app.lastCloseTime = time.Now()
 	}
 	go app.uiLoop()
-	go app.ircLoop("")
+	go app.pingLoop()
+	if app.cfg.Addr != "" {
+		app.startNetwork("", "", app.cfg.NetworkConfig)
+	}
+	for _, n := range app.cfg.Networks {
+		app.win.AddBuffer(n.Name, n.Name, "")
+		app.startNetwork(n.Name, "", n)
+	}
 	app.eventLoop()
 }
 
@@ -232,33 +432,115 @@ func (app *App) eventLoop() {
 	}
 }
 
+// bouncerNetID returns the netID of the network bouncerID, discovered through
+// the connection to parentID.
+func bouncerNetID(parentID, bouncerID string) string {
+	if parentID == "" {
+		return bouncerID
+	}
+	return parentID + "/" + bouncerID
+}
+
+// startNetwork starts maintaining a connection to network n.
+func (app *App) startNetwork(netID, bouncerID string, n NetworkConfig) {
+	ctrl := make(chan netControl, 1)
+	app.networks[netID] = n
+	app.controls[netID] = ctrl
+	go app.ircLoop(netID, bouncerID, n, ctrl)
+}
+
 // ircLoop maintains a connection to the IRC server by connecting and then
-// forwarding IRC events to app.events repeatedly.
-func (app *App) ircLoop(netID string) {
-	var auth irc.SASLClient
-	if app.cfg.Password != nil {
-		auth = &irc.SASLPlain{
-			Username: app.cfg.User,
-			Password: *app.cfg.Password,
-		}
+// forwarding IRC events to app.events repeatedly.  After a connection is lost
+// or fails, it waits increasingly long before trying again, unless it is told
+// otherwise through ctrl.
+//
+// bouncerID is the ID of the bouncer network to bind to, or "" to use the
+// connection as is.
+func (app *App) ircLoop(netID, bouncerID string, n NetworkConfig, ctrl <-chan netControl) {
+	var auths []irc.SASLClient
+	if n.TLSCert != "" {
+		auths = append(auths, &irc.SASLExternal{})
+	}
+	if n.Password != nil {
+		auths = append(auths, &irc.SASLScram{
+			Username: n.User,
+			Password: *n.Password,
+		}, &irc.SASLPlain{
+			Username: n.User,
+			Password: *n.Password,
+		})
 	}
 	params := irc.SessionParams{
-		Nickname: app.cfg.Nick,
-		Username: app.cfg.User,
-		RealName: app.cfg.Real,
-		NetID:    netID,
-		Auth:     auth,
-	}
+		Nickname:     n.Nick,
+		AltNicknames: n.AltNicks,
+		Username:     n.User,
+		RealName:     n.Real,
+		NetID:        bouncerID,
+		Auths:        auths,
+		CTCPReplies:  app.cfg.CTCPReplies,
+	}
+	b := newBackoff(minReconnectDelay, maxReconnectDelay)
 	for !app.win.ShouldExit() {
-		conn := app.connect(netID)
-		in, out := irc.ChanInOut(conn)
+		app.sendNetState(netID, netState{status: netConnecting})
+		conn, c, err := app.connect(netID, n)
+		if err != nil {
+			app.queueStatusLine(netID, ui.Line{
+				Head:      "!!",
+				HeadColor: tcell.ColorRed,
+				Body:      ui.PlainSprintf("Connection failed: %v", err),
+			})
+			app.waitReconnect(netID, ctrl, b.Next(), false)
+			continue
+		}
+
+		// Honor a /disconnect issued while connecting.
+		disconnected := false
+		select {
+		case c := <-ctrl:
+			disconnected = c == netDisconnect
+		default:
+		}
+		if disconnected {
+			conn.Close()
+			app.waitReconnect(netID, ctrl, 0, true)
+			continue
+		}
+
+		app.sendNetState(netID, netState{status: netRegistering})
+		start := time.Now()
+		var in <-chan irc.Message
+		var out chan<- irc.Message
+		var sent <-chan struct{}
+		if ws, ok := conn.(*irc.WebsocketConn); ok {
+			in, out, sent = irc.WebsocketInOut(ws, app.cfg.FloodControl)
+		} else {
+			in, out, sent = irc.ChanInOut(conn, app.cfg.FloodControl)
+		}
+		app.sending.Add(1)
+		go func() {
+			<-sent
+			app.sending.Done()
+		}()
 		if app.cfg.Debug {
 			out = app.debugOutputMessages(netID, out)
 		}
+		_, websocket := conn.(*irc.WebsocketConn)
+		params.TLS = c.TLS
+		params.NoSTS = websocket
 		session := irc.NewSession(out, params)
+		host, port, _ := net.SplitHostPort(address(c))
+		portNum, _ := strconv.Atoi(port)
 		app.events <- event{
-			src:     netID,
-			content: session,
+			src: netID,
+			content: connection{
+				session:   session,
+				conn:      conn,
+				host:      host,
+				port:      portNum,
+				tls:       c.TLS,
+				insecure:  c.TLSInsecure,
+				websocket: websocket,
+			},
 		}
 		go func() {
 			for stop := range session.TypingStops() {
@@ -293,54 +575,69 @@ func (app *App) ircLoop(netID string) {
 		if app.win.ShouldExit() {
 			break
 		}
-		time.Sleep(10 * time.Second)
+		if stableConnection <= time.Since(start) {
+			b.Reset()
+		}
+		app.waitReconnect(netID, ctrl, b.Next(), false)
 	}
 }
 
-func (app *App) connect(netID string) net.Conn {
-	for {
-		app.queueStatusLine(netID, ui.Line{
-			Head: "--",
-			Body: ui.PlainSprintf("Connecting to %s...", app.cfg.Addr),
-		})
-		conn, err := app.tryConnect()
-		if err == nil {
-			return conn
-		}
-		app.queueStatusLine(netID, ui.Line{
-			Head:      "!!",
-			HeadColor: tcell.ColorRed,
-			Body:      ui.PlainSprintf("Connection failed: %v", err),
-		})
-		time.Sleep(1 * time.Minute)
-	}
+// connect connects to the server of n, with the STS policy of the server
+// applied, and returns the connection along with the settings used.
+func (app *App) connect(netID string, n NetworkConfig) (net.Conn, NetworkConfig, error) {
+	c := app.stsUpgrade(n)
+	app.queueStatusLine(netID, ui.Line{
+		Head: "--",
+		Body: ui.PlainSprintf("Connecting to %s...", c.Addr),
+	})
+	conn, err := tryConnect(c)
+	return conn, c, err
 }
 
-func (app *App) tryConnect() (conn net.Conn, err error) {
-	addr := app.cfg.Addr
+// address returns the address of the server of n, with the default port added
+// if missing.
+func address(n NetworkConfig) string {
+	if u, ok := n.websocketURL(); ok {
+		if u.Port() != "" {
+			return u.Host
+		}
+		if u.Scheme == "wss" {
+			return net.JoinHostPort(u.Hostname(), "443")
+		}
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+	addr := n.Addr
 	colonIdx := strings.LastIndexByte(addr, ':')
 	bracketIdx := strings.LastIndexByte(addr, ']')
 	if colonIdx <= bracketIdx {
 		// either colonIdx < 0, or the last colon is before a ']' (end
 		// of IPv6 address. -> missing port
-		if app.cfg.TLS {
+		if n.TLS {
 			addr += ":6697"
 		} else {
 			addr += ":6667"
 		}
 	}
+	return addr
+}
+
+func tryConnect(n NetworkConfig) (conn net.Conn, err error) {
+	addr := address(n)
 
-	conn, err = net.Dial("tcp", addr)
+	conn, err = dial(n, addr)
 	if err != nil {
 		return
 	}
 
-	if app.cfg.TLS {
+	if n.TLS {
 		host, _, _ := net.SplitHostPort(addr) // should succeed since net.Dial did.
-		conn = tls.Client(conn, &tls.Config{
-			ServerName: host,
-			NextProtos: []string{"irc"},
-		})
+		var config *tls.Config
+		config, err = tlsConfig(n, host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tls.Client(conn, config)
 		err = conn.(*tls.Conn).Handshake()
 		if err != nil {
 			conn.Close()
@@ -348,9 +645,90 @@ func (app *App) tryConnect() (conn net.Conn, err error) {
 		}
 	}
 
+	if u, ok := n.websocketURL(); ok {
+		ws, err := irc.WebsocketHandshake(conn, u)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = ws
+	}
+
 	return
 }
 
+// tlsConfig returns the TLS configuration used to connect to the given host of
+// network n.
+func tlsConfig(n NetworkConfig, host string) (*tls.Config, error) {
+	roots, err := n.rootCAs()
+	if err != nil {
+		return nil, err
+	}
+	nextProtos := []string{"irc"}
+	if _, ok := n.websocketURL(); ok {
+		nextProtos = []string{"http/1.1"}
+	}
+	config := &tls.Config{
+		ServerName: host,
+		NextProtos: nextProtos,
+		// The server certificate is verified by VerifyConnection
+		// instead, to support pinning.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyCertificate(n, roots, host, cs.PeerCertificates)
+		},
+	}
+	if n.TLSCert != "" {
+		cert, err := n.clientCertificate()
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// verifyCertificate checks the certificate chain presented by host against the
+// pinned fingerprint of n if any, or against the trusted CAs otherwise.
+func verifyCertificate(n NetworkConfig, roots *x509.CertPool, host string, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("the server presented no certificate")
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	if n.TLSFingerprint != "" {
+		if hex.EncodeToString(sum[:]) != n.TLSFingerprint {
+			return fmt.Errorf("certificate fingerprint mismatch: the server presented SHA-256 fingerprint %s", formatFingerprint(sum[:]))
+		}
+		return nil
+	}
+	if n.TLSInsecure {
+		return nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       host,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return fmt.Errorf("%v (SHA-256 fingerprint: %s)", err, formatFingerprint(sum[:]))
+	}
+	return nil
+}
+
+// formatFingerprint returns the uppercase, colon-separated hexadecimal form of
+// a fingerprint.
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
 func (app *App) debugOutputMessages(netID string, out chan<- irc.Message) chan<- irc.Message {
 	debugOut := make(chan irc.Message, cap(out))
 	go func() {
@@ -367,6 +745,83 @@ func (app *App) debugOutputMessages(netID string, out chan<- irc.Message) chan<-
 	return debugOut
 }
 
+// pingInterval is the time between two lag measurements.
+const pingInterval = 30 * time.Second
+
+type pingTick struct{}
+
+// pingLoop periodically tells app.eventLoop to measure the lag of each
+// connection, and to try to regain taken nicknames.
+func (app *App) pingLoop() {
+	t := time.NewTicker(pingInterval)
+	defer t.Stop()
+	for !app.win.ShouldExit() {
+		<-t.C
+		app.events <- event{
+			src:     "*",
+			content: pingTick{},
+		}
+	}
+}
+
+// checkLag sends a PING through each connection to measure its lag, and closes
+// connections whose previous PING has not been answered in time, so that
+// ircLoop reconnects.
+func (app *App) checkLag() {
+	for netID, s := range app.sessions {
+		if timeout := app.cfg.PingTimeout; timeout != 0 && timeout <= s.PingPending() {
+			app.addStatusLine(netID, ui.Line{
+				At:        time.Now(),
+				Head:      "!!",
+				HeadColor: tcell.ColorRed,
+				Body:      ui.PlainSprintf("The server did not answer for %s, reconnecting...", timeout),
+			})
+			if c, ok := app.connections[netID]; ok {
+				c.conn.Close()
+			}
+			continue
+		}
+		s.Ping()
+	}
+}
+
+// checkAutoAway marks us away on all networks once no key has been pressed
+// for the time given by the auto-away setting.
+func (app *App) checkAutoAway() {
+	if app.cfg.AutoAway == 0 || time.Since(app.lastInput) < app.cfg.AutoAway {
+		return
+	}
+	for netID, s := range app.sessions {
+		if s.IsAway() {
+			continue
+		}
+		s.SetAway(app.cfg.AutoAwayMessage)
+		app.autoAway[netID] = struct{}{}
+	}
+}
+
+// keyPressed records the activity of the user, and brings back the networks
+// that checkAutoAway marked away.
+func (app *App) keyPressed() {
+	app.lastInput = time.Now()
+	for netID := range app.autoAway {
+		if s, ok := app.sessions[netID]; ok && s.IsAway() {
+			s.SetAway("")
+		}
+		delete(app.autoAway, netID)
+	}
+}
+
+// restoreAway marks us away on a network we have just connected to, if we were
+// away before, by /away or auto-away.
+func (app *App) restoreAway(netID string, s *irc.Session) {
+	if app.awayMessage != "" {
+		s.SetAway(app.awayMessage)
+	} else if _, ok := app.autoAway[netID]; ok {
+		s.SetAway(app.cfg.AutoAwayMessage)
+	}
+}
+
 // uiLoop retrieves events from the UI and forwards them to app.events for
 // handling in app.eventLoop().
 func (app *App) uiLoop() {
@@ -387,12 +842,20 @@ func (app *App) handleUIEvent(ev interface{}) bool {
 	case *tcell.EventMouse:
 		app.handleMouseEvent(ev)
 	case *tcell.EventKey:
+		app.keyPressed()
 		app.handleKeyEvent(ev)
+		app.updateListSearch()
 	case *tcell.EventError:
 		// happens when the terminal is closing: in which case, exit
 		return false
 	case statusLine:
 		app.addStatusLine(ev.netID, ev.line)
+	case pingTick:
+		app.checkLag()
+		app.checkAutoAway()
+		for _, s := range app.sessions {
+			s.RegainNick()
+		}
 	default:
 		panic("unreachable")
 	}
@@ -435,6 +898,9 @@ func (app *App) handleMouseEvent(ev *tcell.EventMouse) {
 }
 
 func (app *App) handleKeyEvent(ev *tcell.EventKey) {
+	if app.win.List() != nil && app.handleListKeyEvent(ev) {
+		return
+	}
 	switch ev.Key() {
 	case tcell.KeyCtrlC:
 		if app.win.InputClear() {
@@ -550,6 +1016,86 @@ func (app *App) handleKeyEvent(ev *tcell.EventKey) {
 	}
 }
 
+// handleListKeyEvent handles the keys that act on the list shown in place of
+// the timeline.  It returns false if the key must be handled as usual.
+func (app *App) handleListKeyEvent(ev *tcell.EventKey) bool {
+	list := app.win.List()
+	_, h := app.win.Size()
+	inputEmpty := len(app.win.InputContent()) == 0
+	switch {
+	case ev.Key() == tcell.KeyEscape:
+		app.win.CloseList()
+	case ev.Key() == tcell.KeyUp && ev.Modifiers() == 0:
+		list.Move(-1)
+	case ev.Key() == tcell.KeyDown && ev.Modifiers() == 0:
+		list.Move(1)
+	case ev.Key() == tcell.KeyPgUp:
+		list.Move(-h / 2)
+	case ev.Key() == tcell.KeyPgDn:
+		list.Move(h / 2)
+	case ev.Key() == tcell.KeyRune && ev.Modifiers() == tcell.ModAlt && ev.Rune() == 's':
+		list.SortNext()
+	case ev.Key() == tcell.KeyDelete && inputEmpty && app.list.mode != 0:
+		list.ToggleMark()
+		list.Move(1)
+	case (ev.Key() == tcell.KeyCR || ev.Key() == tcell.KeyLF) && !isCommand(app.win.InputContent()):
+		if app.list.mode != 0 {
+			app.removeMarkedEntries()
+		} else {
+			app.joinSelectedChannel()
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// updateListSearch searches the shown list for the input, unless it is a
+// command.
+func (app *App) updateListSearch() {
+	list := app.win.List()
+	if list == nil {
+		return
+	}
+	input := app.win.InputContent()
+	if string(input) == app.list.input || isCommand(input) {
+		return
+	}
+	app.list.input = string(input)
+	list.Search(app.list.input)
+}
+
+// joinSelectedChannel joins the channel selected in the channel list, and
+// goes back to the timeline.
+func (app *App) joinSelectedChannel() {
+	s := app.sessions[app.list.netID]
+	row, ok := app.win.List().Selected()
+	if s == nil || !ok {
+		return
+	}
+	s.Join(row.Key, "")
+	app.win.CloseList()
+	app.win.InputClear()
+}
+
+// removeMarkedEntries removes the entries marked in the shown mode list from
+// the channel.
+func (app *App) removeMarkedEntries() {
+	s := app.sessions[app.list.netID]
+	if s == nil {
+		return
+	}
+	var changes []irc.ModeChange
+	for _, row := range app.win.List().TakeMarked() {
+		changes = append(changes, irc.ModeChange{
+			Enable: false,
+			Mode:   app.list.mode,
+			Param:  row.Key,
+		})
+	}
+	s.ChangeModes(app.list.channel, changes)
+}
+
 // requestHistory is a wrapper around irc.Session.RequestHistory to only request
 // history when needed.
 func (app *App) requestHistory() {
@@ -574,20 +1120,30 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 		if s, ok := app.sessions[netID]; ok {
 			s.Close()
 			delete(app.sessions, netID)
+			delete(app.connections, netID)
+		}
+		if app.win.List() != nil && app.list.netID == netID {
+			// The list cannot be acted on anymore.
+			app.win.CloseList()
 		}
 		return
 	}
-	if s, ok := ev.(*irc.Session); ok {
+	if c, ok := ev.(connection); ok {
 		if s, ok := app.sessions[netID]; ok {
 			s.Close()
 		}
-		app.sessions[netID] = s
+		app.sessions[netID] = c.session
+		app.connections[netID] = c
 		return
 	}
 	if _, ok := ev.(irc.Typing); ok {
 		// Just refresh the screen.
 		return
 	}
+	if st, ok := ev.(netState); ok {
+		app.setNetState(netID, st)
+		return
+	}
 
 	msg, ok := ev.(irc.Message)
 	if !ok {
@@ -595,7 +1151,9 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 	}
 	s, ok := app.sessions[netID]
 	if !ok {
-		panic("unreachable")
+		// The session has been closed by /disconnect or /reconnect,
+		// and the connection is being torn down.
+		return
 	}
 
 	// Mutate IRC state
@@ -616,16 +1174,17 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 	// Mutate UI state
 	switch ev := ev.(type) {
 	case irc.RegisteredEvent:
-		for _, channel := range app.cfg.Channels {
-			// TODO: group JOIN messages
-			// TODO: support autojoining channels with keys
-			s.Join(channel, "")
-		}
+		app.setNetState(netID, netState{status: netConnected})
+		n := app.networks[netID]
+		// TODO: support autojoining channels with keys
+		s.JoinChannels(n.Channels)
+		s.Monitor(n.Monitor...)
 		s.NewHistoryRequest("").
 			WithLimit(1000).
 			Targets(app.lastCloseTime, msg.TimeOrNow())
+		app.restoreAway(netID, s)
 		body := "Connected to the server"
-		if s.Nick() != app.cfg.Nick {
+		if s.Nick() != n.Nick {
 			body = fmt.Sprintf("Connected to the server as %s", s.Nick())
 		}
 		app.win.AddLine(netID, "", ui.NotifyNone, ui.Line{
@@ -633,6 +1192,8 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 			Head: "--",
 			Body: ui.PlainString(body),
 		})
+	case irc.STSEvent:
+		app.handleSTS(netID, ev.Policy)
 	case irc.SelfNickEvent:
 		var body ui.StyledStringBuilder
 		body.WriteString(fmt.Sprintf("%s\u2192%s", ev.FormerNick, s.Nick()))
@@ -648,13 +1209,41 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 			Body:      body.StyledString(),
 			Highlight: true,
 		})
+	case irc.SelfAwayEvent:
+		body := "You are no longer marked as being away"
+		if ev.Away {
+			body = "You have been marked as being away"
+		}
+		app.addStatusLine(netID, ui.Line{
+			At:        msg.TimeOrNow(),
+			Head:      "--",
+			HeadColor: tcell.ColorGray,
+			Body:      ui.Styled(body, tcell.StyleDefault.Foreground(tcell.ColorGray)),
+		})
+	case irc.UserAwayEvent:
+		// Show the reply where the user has been talked to or asked about.
+		buffer := ""
+		if curNetID, curBuffer := app.win.CurrentBuffer(); curNetID == netID {
+			buffer = curBuffer
+		}
+		app.win.AddLine(netID, buffer, ui.NotifyNone, ui.Line{
+			At:        msg.TimeOrNow(),
+			Head:      "--",
+			HeadColor: tcell.ColorGray,
+			Body:      ui.Styled(fmt.Sprintf("%s is away: %s", ev.User, ev.Message), tcell.StyleDefault.Foreground(tcell.ColorGray)),
+		})
 	case irc.UserNickEvent:
 		line := app.formatEvent(ev)
 		for _, c := range s.ChannelsSharedWith(ev.User) {
-			app.win.AddLine(netID, c, ui.NotifyNone, line)
+			app.addLine(netID, c, ui.NotifyNone, line)
 		}
+	case irc.UserHostEvent:
+		app.addUserChangeLine(netID, s, ev.User, app.formatEvent(ev))
+	case irc.UserRealNameEvent:
+		app.addUserChangeLine(netID, s, ev.User, app.formatEvent(ev))
 	case irc.SelfJoinEvent:
 		i, added := app.win.AddBuffer(netID, "", ev.Channel)
+		app.win.SetBufferStatus(netID, ev.Channel, "")
 		bounds, ok := app.messageBounds[boundKey{netID, ev.Channel}]
 		if added || !ok {
 			s.NewHistoryRequest(ev.Channel).
@@ -681,26 +1270,54 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 		}
 	case irc.UserJoinEvent:
 		line := app.formatEvent(ev)
-		app.win.AddLine(netID, ev.Channel, ui.NotifyNone, line)
+		app.addLine(netID, ev.Channel, ui.NotifyNone, line)
 	case irc.SelfPartEvent:
 		app.win.RemoveBuffer(netID, ev.Channel)
 		delete(app.messageBounds, boundKey{netID, ev.Channel})
+	case irc.SelfKickEvent:
+		// Keep the buffer, to see what has been said before the kick.
+		app.win.SetBufferStatus(netID, ev.Channel, "parted")
+		var body ui.StyledStringBuilder
+		body.SetStyle(tcell.StyleDefault.Foreground(tcell.ColorRed))
+		fmt.Fprintf(&body, "You have been kicked from %s by ", ev.Channel)
+		body.SetStyle(tcell.StyleDefault.Foreground(identColor(ev.Kicker)))
+		body.WriteString(ev.Kicker)
+		if ev.Comment != "" {
+			body.SetStyle(tcell.StyleDefault)
+			body.WriteString(": ")
+			body.WriteStyledString(ui.IRCString(ev.Comment))
+		}
+		line := ui.Line{
+			At:        ev.Time,
+			Head:      "!!",
+			HeadColor: tcell.ColorRed,
+			Body:      body.StyledString(),
+			Highlight: true,
+		}
+		app.win.AddLine(netID, ev.Channel, ui.NotifyHighlight, line)
+		app.notifyHighlight(ev.Channel, ev.Kicker, line.Body.String())
 	case irc.UserPartEvent:
 		line := app.formatEvent(ev)
-		app.win.AddLine(netID, ev.Channel, ui.NotifyNone, line)
+		app.addLine(netID, ev.Channel, ui.NotifyNone, line)
+	case irc.UserKickEvent:
+		line := app.formatEvent(ev)
+		app.addLine(netID, ev.Channel, ui.NotifyUnread, line)
 	case irc.UserQuitEvent:
 		line := app.formatEvent(ev)
 		for _, c := range ev.Channels {
-			app.win.AddLine(netID, c, ui.NotifyNone, line)
+			app.addLine(netID, c, ui.NotifyNone, line)
 		}
 	case irc.TopicChangeEvent:
 		line := app.formatEvent(ev)
-		app.win.AddLine(netID, ev.Channel, ui.NotifyUnread, line)
+		app.addLine(netID, ev.Channel, ui.NotifyUnread, line)
 		topic := ui.IRCString(ev.Topic).String()
 		app.win.SetTopic(netID, ev.Channel, topic)
 	case irc.ModeChangeEvent:
 		line := app.formatEvent(ev)
-		app.win.AddLine(netID, ev.Channel, ui.NotifyNone, line)
+		app.addLine(netID, ev.Channel, ui.NotifyNone, line)
+		app.win.SetModes(netID, ev.Channel, s.ChannelModes(ev.Channel))
+	case irc.ChannelModesEvent:
+		app.win.SetModes(netID, ev.Channel, s.ChannelModes(ev.Channel))
 	case irc.InviteEvent:
 		var buffer string
 		var notify ui.NotifyType
@@ -725,6 +1342,135 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 			Body:      ui.Styled(body, tcell.StyleDefault.Foreground(tcell.ColorGray)),
 			Highlight: notify == ui.NotifyHighlight,
 		})
+	case irc.ModeListEvent:
+		if curNetID, _ := app.win.CurrentBuffer(); curNetID != netID {
+			// Another network is shown since the list has been asked for.
+			break
+		}
+		rows := make([]ui.ListRow, 0, len(ev.Entries))
+		for _, entry := range ev.Entries {
+			var setAt string
+			if !entry.SetAt.IsZero() {
+				setAt = entry.SetAt.Local().Format("2006-01-02 15:04")
+			}
+			rows = append(rows, ui.ListRow{
+				Key:   entry.Mask,
+				Cells: []string{entry.Mask, entry.SetBy, setAt},
+			})
+		}
+		title := fmt.Sprintf("%s of %s (%d)", modeListNames[ev.Mode], ev.Channel, len(rows))
+		help := "Type to search, Delete to mark for removal, Enter to remove marked entries, Alt-S to sort, Escape to close"
+		app.list = shownList{netID: netID, channel: ev.Channel, mode: ev.Mode, maxUsers: -1}
+		app.win.OpenList(ui.NewList(title, help, []string{"Mask", "Set by", "Date"}, rows))
+	case irc.ChannelListEvent:
+		for _, c := range ev.Channels {
+			app.channelLists[netID] = append(app.channelLists[netID], c.Name)
+		}
+		list := app.win.List()
+		if list == nil || app.list.netID != netID || app.list.mode != 0 {
+			break
+		}
+		rows := make([]ui.ListRow, 0, len(ev.Channels))
+		for _, c := range ev.Channels {
+			if !app.list.matches(s, c) {
+				continue
+			}
+			rows = append(rows, ui.ListRow{
+				Key:   c.Name,
+				Cells: []string{c.Name, strconv.Itoa(c.Users), ui.IRCString(c.Topic).String()},
+			})
+		}
+		list.AddRows(rows...)
+		list.SetTitle(channelListTitle(list.Len(), ev.Done))
+	case irc.WhoisEvent:
+		// Show the reply where it has been asked for.
+		buffer := ""
+		if curNetID, curBuffer := app.win.CurrentBuffer(); curNetID == netID {
+			buffer = curBuffer
+		}
+		for _, body := range formatWhois(ev) {
+			app.win.AddLine(netID, buffer, ui.NotifyNone, ui.Line{
+				At:        msg.TimeOrNow(),
+				Head:      "--",
+				HeadColor: tcell.ColorGray,
+				Body:      body,
+			})
+		}
+	case irc.MonitorEvent:
+		status := "offline"
+		color := tcell.ColorRed
+		if ev.Online {
+			status = "online"
+			color = tcell.ColorGreen
+		}
+		for _, nick := range ev.Users {
+			var body ui.StyledStringBuilder
+			body.SetStyle(tcell.StyleDefault.Foreground(identColor(nick)))
+			body.WriteString(nick)
+			body.SetStyle(tcell.StyleDefault.Foreground(tcell.ColorGray))
+			body.WriteString(" is ")
+			body.SetStyle(tcell.StyleDefault.Foreground(color))
+			body.WriteString(status)
+			app.addStatusLine(netID, ui.Line{
+				At:        msg.TimeOrNow(),
+				Head:      "--",
+				HeadColor: tcell.ColorGray,
+				Body:      body.StyledString(),
+			})
+			if app.cfg.MonitorHighlight {
+				app.notifyHighlight("", nick, "is "+status)
+			}
+		}
+	case irc.CTCPEvent:
+		if s.IsMe(ev.User) {
+			break
+		}
+		var body ui.StyledStringBuilder
+		body.SetStyle(tcell.StyleDefault.Foreground(identColor(ev.User)))
+		body.WriteString(ev.User)
+		body.SetStyle(tcell.StyleDefault.Foreground(tcell.ColorGray))
+		fmt.Fprintf(&body, " sent a CTCP %s request", ev.Command)
+		if s.IsChannel(ev.Target) {
+			fmt.Fprintf(&body, " to %s", ev.Target)
+		}
+		if ev.Replied {
+			body.WriteString(" (answered)")
+		}
+		app.win.AddLine(netID, "", ui.NotifyNone, ui.Line{
+			At:        ev.Time,
+			Head:      "--",
+			HeadColor: tcell.ColorGray,
+			Body:      body.StyledString(),
+		})
+	case irc.CTCPReplyEvent:
+		if s.IsMe(ev.User) {
+			break
+		}
+		// Show the reply where it has been asked for.
+		buffer := ""
+		if curNetID, curBuffer := app.win.CurrentBuffer(); curNetID == netID {
+			buffer = curBuffer
+		}
+		params := ev.Params
+		if ev.Command == "PING" {
+			if sent, err := strconv.ParseInt(params, 10, 64); err == nil {
+				params = time.Since(time.Unix(0, sent)).Round(time.Millisecond).String()
+			}
+		}
+		var body ui.StyledStringBuilder
+		body.SetStyle(tcell.StyleDefault.Foreground(identColor(ev.User)))
+		body.WriteString(ev.User)
+		body.SetStyle(tcell.StyleDefault.Bold(true))
+		fmt.Fprintf(&body, " %s", ev.Command)
+		body.SetStyle(tcell.StyleDefault)
+		body.WriteString(": ")
+		body.WriteStyledString(ui.IRCString(params))
+		app.win.AddLine(netID, buffer, ui.NotifyNone, ui.Line{
+			At:        ev.Time,
+			Head:      "--",
+			HeadColor: tcell.ColorGray,
+			Body:      body.StyledString(),
+		})
 	case irc.MessageEvent:
 		buffer, line, notification := app.formatMessage(s, ev)
 		if buffer != "" && !s.IsChannel(buffer) {
@@ -734,7 +1480,7 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 					Before(msg.TimeOrNow())
 			}
 		}
-		app.win.AddLine(netID, buffer, notification, line)
+		app.addLine(netID, buffer, notification, line)
 		if notification == ui.NotifyHighlight {
 			app.notifyHighlight(buffer, ev.User, line.Body.String())
 		}
@@ -742,9 +1488,12 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 			app.lastQuery = msg.Prefix.Name
 			app.lastQueryNet = netID
 		}
-		bounds := app.messageBounds[boundKey{netID, ev.Target}]
-		bounds.Update(&line)
-		app.messageBounds[boundKey{netID, buffer}] = bounds
+	case irc.ReactionEvent:
+		buffer := targetBuffer(s, ev.User, ev.Target, ev.TargetIsChannel)
+		app.win.AddReaction(netID, buffer, ev.ReplyTo, ev.User, ev.Reaction)
+	case irc.RedactEvent:
+		buffer := targetBuffer(s, ev.User, ev.Target, ev.TargetIsChannel)
+		app.redactLine(netID, buffer, ev)
 	case irc.HistoryTargetsEvent:
 		for target, last := range ev.Targets {
 			if s.IsChannel(target) {
@@ -761,12 +1510,18 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 	case irc.HistoryEvent:
 		var linesBefore []ui.Line
 		var linesAfter []ui.Line
+		var linesWithin []ui.Line // missing from the buffer.
+		var edits []irc.Event     // reactions and redactions.
 		bounds, hasBounds := app.messageBounds[boundKey{netID, ev.Target}]
 		for _, m := range ev.Messages {
 			var line ui.Line
 			switch ev := m.(type) {
 			case irc.MessageEvent:
 				_, line, _ = app.formatMessage(s, ev)
+			case irc.ReactionEvent, irc.RedactEvent:
+				// Applied once the lines they refer to are added.
+				edits = append(edits, ev)
+				continue
 			default:
 				line = app.formatEvent(ev)
 			}
@@ -779,27 +1534,36 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 					linesBefore = append(linesBefore, line)
 				} else if c > 0 {
 					linesAfter = append(linesAfter, line)
+				} else if !bounds.Has(&line) {
+					linesWithin = append(linesWithin, line)
 				}
 			} else {
 				linesBefore = append(linesBefore, line)
 			}
 		}
 		app.win.AddLines(netID, ev.Target, linesBefore, linesAfter)
-		if len(linesBefore) != 0 {
-			bounds.Update(&linesBefore[0])
-			bounds.Update(&linesBefore[len(linesBefore)-1])
+		app.win.InsertLines(netID, ev.Target, linesWithin)
+		for _, edit := range edits {
+			switch edit := edit.(type) {
+			case irc.ReactionEvent:
+				app.win.AddReaction(netID, ev.Target, edit.ReplyTo, edit.User, edit.Reaction)
+			case irc.RedactEvent:
+				app.redactLine(netID, ev.Target, edit)
+			}
 		}
-		if len(linesAfter) != 0 {
-			bounds.Update(&linesAfter[0])
-			bounds.Update(&linesAfter[len(linesAfter)-1])
+		for _, lines := range [][]ui.Line{linesBefore, linesAfter, linesWithin} {
+			for i := range lines {
+				bounds.Update(&lines[i])
+			}
 		}
 		if !bounds.IsZero() {
 			app.messageBounds[boundKey{netID, ev.Target}] = bounds
 		}
 	case irc.BouncerNetworkEvent:
-		_, added := app.win.AddBuffer(ev.ID, ev.Name, "")
+		id := bouncerNetID(netID, ev.ID)
+		_, added := app.win.AddBuffer(id, ev.Name, "")
 		if added {
-			go app.ircLoop(ev.ID)
+			app.startNetwork(id, ev.ID, app.networks[netID])
 		}
 	case irc.ErrorEvent:
 		if isBlackListed(msg.Command) {
@@ -909,7 +1673,7 @@ func (app *App) typing() {
 	if s == nil || !app.cfg.Typings {
 		return
 	}
-	if buffer == "" {
+	if buffer == "" || app.win.List() != nil {
 		return
 	}
 	input := app.win.InputContent()
@@ -935,9 +1699,14 @@ func (app *App) completions(cursorIdx int, text []rune) []ui.Completion {
 	var cs []ui.Completion
 	if buffer != "" {
 		cs = app.completionsChannelTopic(cs, cursorIdx, text)
-		cs = app.completionsChannelMembers(cs, cursorIdx, text)
+		if _, filter := memberCommand(text); filter != nil {
+			cs = app.completionsMemberCommands(cs, cursorIdx, text)
+		} else {
+			cs = app.completionsChannelMembers(cs, cursorIdx, text)
+		}
 	}
 	cs = app.completionsMsg(cs, cursorIdx, text)
+	cs = app.completionsJoin(cs, cursorIdx, text)
 
 	if cs != nil {
 		cs = append(cs, ui.Completion{
@@ -949,6 +1718,109 @@ func (app *App) completions(cursorIdx int, text []rune) []ui.Completion {
 	return cs
 }
 
+// formatWhois returns the lines of a WHOIS reply: the identity of the user,
+// followed by one line per piece of information.
+func formatWhois(ev irc.WhoisEvent) []ui.StyledString {
+	var sb ui.StyledStringBuilder
+	sb.WriteStyledString(identString(ev.Nick))
+	if ev.User != "" {
+		sb.WriteString(fmt.Sprintf(" (%s@%s)", ev.User, ev.Host))
+	}
+	if ev.RealName != "" {
+		sb.WriteString(": ")
+		sb.WriteStyledString(ui.IRCString(ev.RealName))
+	}
+	bodies := []ui.StyledString{sb.StyledString()}
+
+	labelStyle := tcell.StyleDefault.Foreground(tcell.ColorGray)
+	field := func(label, value string) {
+		sb.Reset()
+		sb.SetStyle(labelStyle)
+		sb.WriteString(fmt.Sprintf("  %-10s", label))
+		sb.SetStyle(tcell.StyleDefault)
+		sb.WriteString(value)
+		bodies = append(bodies, sb.StyledString())
+	}
+	if ev.Account != "" {
+		field("account", ev.Account)
+	}
+	if len(ev.Channels) != 0 {
+		field("channels", strings.Join(ev.Channels, " "))
+	}
+	if ev.Server != "" {
+		field("server", fmt.Sprintf("%s (%s)", ev.Server, ev.ServerInfo))
+	}
+	if ev.Idle != 0 {
+		field("idle", ev.Idle.String())
+	}
+	if !ev.Signon.IsZero() {
+		field("connected", ev.Signon.Local().Format("2006-01-02 15:04"))
+	}
+	if ev.Away != "" {
+		field("away", ev.Away)
+	}
+	if ev.Secure {
+		field("security", "secure connection")
+	}
+	if ev.Operator {
+		field("operator", "IRC operator")
+	}
+	for _, info := range ev.Info {
+		field("", info)
+	}
+	return bodies
+}
+
+// addUserChangeLine shows line, about a change of user, in the channels shared
+// with user, or as a status line if user is us.
+func (app *App) addUserChangeLine(netID string, s *irc.Session, user string, line ui.Line) {
+	if s.IsMe(user) {
+		line.Mergeable = false
+		app.addStatusLine(netID, line)
+		return
+	}
+	for _, c := range s.ChannelsSharedWith(user) {
+		app.addLine(netID, c, ui.NotifyNone, line)
+	}
+}
+
+// addLine adds line to the given buffer, and records it in the bounds of the
+// buffer so that it is not added again from history.
+func (app *App) addLine(netID, buffer string, notify ui.NotifyType, line ui.Line) {
+	app.win.AddLine(netID, buffer, notify, line)
+	key := boundKey{netID, buffer}
+	bounds := app.messageBounds[key]
+	bounds.Update(&line)
+	if !bounds.IsZero() {
+		app.messageBounds[key] = bounds
+	}
+}
+
+// changeBody returns the body of a status line that shows the change of an
+// attribute of user, from former (if known) to current.
+func changeBody(user, former, current string) ui.StyledString {
+	var body ui.StyledStringBuilder
+	textStyle := tcell.StyleDefault.Foreground(tcell.ColorGray)
+	body.SetStyle(textStyle)
+	body.WriteString(user + ": " + former)
+	body.SetStyle(tcell.StyleDefault)
+	body.WriteString("\u2192")
+	body.SetStyle(textStyle)
+	body.WriteString(current)
+	return body.StyledString()
+}
+
+// writeReason writes the reason of a part or quit, if any, after its nick.
+func writeReason(body *ui.StyledStringBuilder, reason string) {
+	if reason == "" {
+		return
+	}
+	body.SetStyle(tcell.StyleDefault.Foreground(tcell.ColorGray))
+	body.WriteString(" (")
+	body.WriteString(ui.IRCString(reason).String())
+	body.WriteString(")")
+}
+
 // formatEvent returns a formatted ui.Line for an irc.Event.
 func (app *App) formatEvent(ev irc.Event) ui.Line {
 	switch ev := ev.(type) {
@@ -962,12 +1834,33 @@ func (app *App) formatEvent(ev irc.Event) ui.Line {
 		body.AddStyle(body.Len()-len(ev.User), textStyle)
 		return ui.Line{
 			At:        ev.Time,
+			ID:        ev.ID,
 			Head:      "--",
 			HeadColor: tcell.ColorGray,
 			Body:      body.StyledString(),
 			Mergeable: true,
 			Data:      []interface{}{ev},
 		}
+	case irc.UserHostEvent:
+		return ui.Line{
+			At:        ev.Time,
+			ID:        ev.ID,
+			Head:      "--",
+			HeadColor: tcell.ColorGray,
+			Body:      changeBody(ev.User, ev.FormerHost, ev.Host),
+			Mergeable: true,
+			Data:      []interface{}{ev},
+		}
+	case irc.UserRealNameEvent:
+		return ui.Line{
+			At:        ev.Time,
+			ID:        ev.ID,
+			Head:      "--",
+			HeadColor: tcell.ColorGray,
+			Body:      changeBody(ev.User, ui.IRCString(ev.FormerRealName).String(), ui.IRCString(ev.RealName).String()),
+			Mergeable: true,
+			Data:      []interface{}{ev},
+		}
 	case irc.UserJoinEvent:
 		var body ui.StyledStringBuilder
 		body.Grow(len(ev.User) + 1)
@@ -977,6 +1870,7 @@ func (app *App) formatEvent(ev irc.Event) ui.Line {
 		body.WriteString(ev.User)
 		return ui.Line{
 			At:        ev.Time,
+			ID:        ev.ID,
 			Head:      "--",
 			HeadColor: tcell.ColorGray,
 			Body:      body.StyledString(),
@@ -990,8 +1884,10 @@ func (app *App) formatEvent(ev irc.Event) ui.Line {
 		body.WriteByte('-')
 		body.SetStyle(tcell.StyleDefault.Foreground(tcell.ColorGray))
 		body.WriteString(ev.User)
+		writeReason(&body, ev.Reason)
 		return ui.Line{
 			At:        ev.Time,
+			ID:        ev.ID,
 			Head:      "--",
 			HeadColor: tcell.ColorGray,
 			Body:      body.StyledString(),
@@ -1005,27 +1901,53 @@ func (app *App) formatEvent(ev irc.Event) ui.Line {
 		body.WriteByte('-')
 		body.SetStyle(tcell.StyleDefault.Foreground(tcell.ColorGray))
 		body.WriteString(ev.User)
+		writeReason(&body, ev.Reason)
 		return ui.Line{
 			At:        ev.Time,
+			ID:        ev.ID,
 			Head:      "--",
 			HeadColor: tcell.ColorGray,
 			Body:      body.StyledString(),
 			Mergeable: true,
 			Data:      []interface{}{ev},
 		}
+	case irc.UserKickEvent:
+		var body ui.StyledStringBuilder
+		body.SetStyle(tcell.StyleDefault.Foreground(tcell.ColorRed))
+		body.WriteByte('-')
+		body.SetStyle(tcell.StyleDefault.Foreground(identColor(ev.User)))
+		body.WriteString(ev.User)
+		body.SetStyle(tcell.StyleDefault.Foreground(tcell.ColorGray))
+		body.WriteString(" has been kicked by ")
+		body.SetStyle(tcell.StyleDefault.Foreground(identColor(ev.Kicker)))
+		body.WriteString(ev.Kicker)
+		if ev.Comment != "" {
+			body.SetStyle(tcell.StyleDefault.Foreground(tcell.ColorGray))
+			body.WriteString(": ")
+			body.WriteStyledString(ui.IRCString(ev.Comment))
+		}
+		return ui.Line{
+			At:        ev.Time,
+			ID:        ev.ID,
+			Head:      "--",
+			HeadColor: tcell.ColorGray,
+			Body:      body.StyledString(),
+		}
 	case irc.TopicChangeEvent:
 		topic := ui.IRCString(ev.Topic).String()
 		body := fmt.Sprintf("Topic changed to: %s", topic)
 		return ui.Line{
 			At:        ev.Time,
+			ID:        ev.ID,
 			Head:      "--",
 			HeadColor: tcell.ColorGray,
 			Body:      ui.Styled(body, tcell.StyleDefault.Foreground(tcell.ColorGray)),
 		}
 	case irc.ModeChangeEvent:
-		body := fmt.Sprintf("[%s]", ev.Mode)
+		body := describeModeChange(ev)
 		return ui.Line{
 			At:        ev.Time,
+			ID:        ev.ID,
 			Head:      "--",
 			HeadColor: tcell.ColorGray,
 			Body:      ui.Styled(body, tcell.StyleDefault.Foreground(tcell.ColorGray)),
@@ -1037,6 +1959,90 @@ func (app *App) formatEvent(ev irc.Event) ui.Line {
 	}
 }
 
+// memberModeNames are the names given to well-known membership modes, when
+// the server uses them as such.
+var memberModeNames = map[byte]string{
+	'q': "owner",
+	'a': "admin",
+	'o': "operator",
+	'h': "half-operator",
+	'v': "voice",
+}
+
+// channelModeDescriptions describe well-known channel modes without
+// parameters, when they are set and when they are unset.
+var channelModeDescriptions = map[byte][2]string{
+	'i': {"made the channel invite-only", "made the channel no longer invite-only"},
+	'm': {"made the channel moderated", "made the channel no longer moderated"},
+	'n': {"forbade messages from outside the channel", "allowed messages from outside the channel"},
+	'p': {"made the channel private", "made the channel no longer private"},
+	's': {"made the channel secret", "made the channel no longer secret"},
+	't': {"restricted topic changes to operators", "allowed anyone to change the topic"},
+}
+
+// describeModeChange returns a human-readable description of a mode change,
+// such as "alice gave operator status to bob, set the channel key".
+func describeModeChange(ev irc.ModeChangeEvent) string {
+	if ev.User == "" || len(ev.Changes) == 0 {
+		return fmt.Sprintf("[%s]", ev.Mode)
+	}
+	descriptions := make([]string, 0, len(ev.Changes))
+	for _, change := range ev.Changes {
+		var d string
+		if name, ok := memberModeNames[change.Mode]; ok && change.Membership {
+			if change.Enable {
+				d = fmt.Sprintf("gave %s status to %s", name, change.Param)
+			} else {
+				d = fmt.Sprintf("removed %s status from %s", name, change.Param)
+			}
+		} else if desc, ok := channelModeDescriptions[change.Mode]; ok && change.Param == "" {
+			if change.Enable {
+				d = desc[0]
+			} else {
+				d = desc[1]
+			}
+		} else {
+			switch {
+			case change.Mode == 'b' && change.Enable:
+				d = fmt.Sprintf("banned %s", change.Param)
+			case change.Mode == 'b':
+				d = fmt.Sprintf("unbanned %s", change.Param)
+			case change.Mode == 'e' && change.Enable:
+				d = fmt.Sprintf("added a ban exception for %s", change.Param)
+			case change.Mode == 'e':
+				d = fmt.Sprintf("removed the ban exception for %s", change.Param)
+			case change.Mode == 'I' && change.Enable:
+				d = fmt.Sprintf("added an invite exception for %s", change.Param)
+			case change.Mode == 'I':
+				d = fmt.Sprintf("removed the invite exception for %s", change.Param)
+			case change.Mode == 'q' && change.Param != "" && change.Enable:
+				d = fmt.Sprintf("quieted %s", change.Param)
+			case change.Mode == 'q' && change.Param != "":
+				d = fmt.Sprintf("removed the quiet on %s", change.Param)
+			case change.Mode == 'k' && change.Enable:
+				d = "set the channel key"
+			case change.Mode == 'k':
+				d = "removed the channel key"
+			case change.Mode == 'l' && change.Enable:
+				d = fmt.Sprintf("set the user limit to %s", change.Param)
+			case change.Mode == 'l':
+				d = "removed the user limit"
+			default:
+				sign := '-'
+				if change.Enable {
+					sign = '+'
+				}
+				d = fmt.Sprintf("set mode %c%c", sign, change.Mode)
+				if change.Param != "" {
+					d += " " + change.Param
+				}
+			}
+		}
+		descriptions = append(descriptions, d)
+	}
+	return ev.User + " " + strings.Join(descriptions, ", ")
+}
+
 // formatMessage sets how a given message must be formatted.
 //
 // It computes three things:
@@ -1053,7 +2059,7 @@ func (app *App) formatMessage(s *irc.Session, ev irc.MessageEvent) (buffer strin
 
 	if !ev.TargetIsChannel && isNotice {
 		curNetID, curBuffer := app.win.CurrentBuffer()
-		if curNetID == s.NetID() {
+		if app.sessions[curNetID] == s {
 			buffer = curBuffer
 		} else {
 			isHighlight = true
@@ -1073,12 +2079,19 @@ func (app *App) formatMessage(s *irc.Session, ev irc.MessageEvent) (buffer strin
 		notification = ui.NotifyUnread
 	}
 
-	head := ev.User
-	headColor := tcell.ColorWhite
+	nick := ev.User
+	nickColor := identColor(ev.User)
+	if ev.Unidentified {
+		// Someone else is using the nick of a logged in user.
+		nick += "?"
+		nickColor = tcell.ColorGray
+	}
+
+	head := nick
+	headColor := nickColor
 	if isAction || isNotice {
 		head = "*"
-	} else {
-		headColor = identColor(head)
+		headColor = tcell.ColorWhite
 	}
 
 	content := strings.TrimSuffix(ev.Content, "\x01")
@@ -1088,16 +2101,14 @@ func (app *App) formatMessage(s *irc.Session, ev irc.MessageEvent) (buffer strin
 	}
 	var body ui.StyledStringBuilder
 	if isNotice {
-		color := identColor(ev.User)
-		body.SetStyle(tcell.StyleDefault.Foreground(color))
-		body.WriteString(ev.User)
+		body.SetStyle(tcell.StyleDefault.Foreground(nickColor))
+		body.WriteString(nick)
 		body.SetStyle(tcell.StyleDefault)
 		body.WriteString(": ")
 		body.WriteStyledString(ui.IRCString(content))
 	} else if isAction {
-		color := identColor(ev.User)
-		body.SetStyle(tcell.StyleDefault.Foreground(color))
-		body.WriteString(ev.User)
+		body.SetStyle(tcell.StyleDefault.Foreground(nickColor))
+		body.WriteString(nick)
 		body.SetStyle(tcell.StyleDefault)
 		body.WriteStyledString(ui.IRCString(content))
 	} else {
@@ -1106,14 +2117,47 @@ func (app *App) formatMessage(s *irc.Session, ev irc.MessageEvent) (buffer strin
 
 	line = ui.Line{
 		At:        ev.Time,
+		ID:        ev.ID,
 		Head:      head,
 		HeadColor: headColor,
 		Body:      body.StyledString(),
 		Highlight: hlLine,
+		Data:      []interface{}{ev},
+		ReplyTo:   ev.ReplyTo,
 	}
 	return
 }
 
+// targetBuffer returns the buffer of the messages sent by user to target.
+func targetBuffer(s *irc.Session, user, target string, targetIsChannel bool) string {
+	if !targetIsChannel && s.IsMe(target) {
+		return user
+	}
+	return target
+}
+
+// redactLine replaces the line of the message deleted by ev with a
+// placeholder.
+func (app *App) redactLine(netID, buffer string, ev irc.RedactEvent) {
+	line, ok := app.win.FindLine(netID, buffer, func(line *ui.Line) bool {
+		return line.ID == ev.Redacted
+	})
+	if !ok {
+		return
+	}
+	text := "message deleted"
+	if len(line.Data) != 0 {
+		if msg, ok := line.Data[0].(irc.MessageEvent); ok && msg.User != ev.User {
+			text += " by " + ev.User
+		}
+	}
+	if ev.Reason != "" {
+		text += ": " + ev.Reason
+	}
+	body := ui.Styled(text, tcell.StyleDefault.Foreground(tcell.ColorGray).Italic(true))
+	app.win.RedactLine(netID, buffer, ev.Redacted, body)
+}
+
 func (app *App) mergeLine(former *ui.Line, addition ui.Line) {
 	partQuitUser := func(ev interface{}) string {
 		if ev, ok := ev.(irc.UserQuitEvent); ok {
@@ -1210,11 +2254,21 @@ func (app *App) updatePrompt() {
 				Foreground(tcell.Color(app.cfg.Colors.Prompt)),
 		)
 	} else if s == nil {
-		prompt = ui.Styled("<offline>",
+		state := app.netStates[netID].String()
+		if state == "" {
+			state = "offline"
+		}
+		prompt = ui.Styled("<"+state+">",
 			tcell.
 				StyleDefault.
 				Foreground(tcell.ColorRed),
 		)
+	} else if s.IsAway() {
+		prompt = ui.Styled(s.Nick(),
+			tcell.
+				StyleDefault.
+				Foreground(tcell.ColorGray),
+		)
 	} else {
 		prompt = identString(s.Nick())
 	}
@@ -0,0 +1,545 @@
+package senpai
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~taiite/senpai/irc"
+	"git.sr.ht/~taiite/senpai/ui"
+)
+
+// newCertificate creates a certificate for name, signed by parent or
+// self-signed if parent is nil.
+func newCertificate(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	issuer, signer := template, interface{}(key)
+	if parent != nil {
+		issuer = parent.Leaf
+		signer = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+// writeCertificate writes the certificate and its key in PEM format, to
+// separate files in dir.
+func writeCertificate(t *testing.T, dir string, cert tls.Certificate) (certPath, keyPath string) {
+	certPath = filepath.Join(dir, cert.Leaf.Subject.CommonName+".crt")
+	keyPath = filepath.Join(dir, cert.Leaf.Subject.CommonName+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// listenTLS starts a TLS server that accepts a single connection and sends
+// the certificate presented by the client, or nil, to the returned channel.
+func listenTLS(t *testing.T, config *tls.Config) (addr string, clientCerts <-chan *x509.Certificate) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	certs := make(chan *x509.Certificate, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(certs)
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			close(certs)
+			return
+		}
+		var cert *x509.Certificate
+		if peers := tlsConn.ConnectionState().PeerCertificates; len(peers) != 0 {
+			cert = peers[0]
+		}
+		certs <- cert
+	}()
+	return ln.Addr().String(), certs
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	server := newCertificate(t, "localhost", nil)
+	client := newCertificate(t, "senpai", nil)
+	certPath, keyPath := writeCertificate(t, dir, client)
+
+	addr, clientCerts := listenTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+
+	n := NetworkConfig{
+		Addr:    addr,
+		Nick:    "senpai",
+		TLS:     true,
+		TLSCert: certPath,
+		TLSKey:  keyPath,
+	}
+	n.TLSCA, _ = writeCertificate(t, dir, server)
+	if err := n.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := tryConnect(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cert := <-clientCerts
+	if cert == nil {
+		t.Fatal("the server did not receive a client certificate")
+	}
+	if !cert.Equal(client.Leaf) {
+		t.Errorf("expected the client to present %q, got %q", client.Leaf.Subject, cert.Subject)
+	}
+}
+
+func TestClientCertificateKeyInCert(t *testing.T) {
+	dir := t.TempDir()
+	client := newCertificate(t, "senpai", nil)
+	certPath, keyPath := writeCertificate(t, dir, client)
+
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(certPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(key); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	n := NetworkConfig{
+		Addr:    "localhost",
+		Nick:    "senpai",
+		TLS:     true,
+		TLSCert: certPath,
+	}
+	if err := n.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	n.TLS = false
+	if err := n.check(); err == nil {
+		t.Error("expected a client certificate without TLS to be rejected")
+	}
+}
+
+func TestServerVerification(t *testing.T) {
+	dir := t.TempDir()
+	server := newCertificate(t, "localhost", nil)
+	caPath, _ := writeCertificate(t, dir, server)
+	sum := sha256.Sum256(server.Leaf.Raw)
+	other := sha256.Sum256([]byte("other"))
+
+	tests := []struct {
+		name    string
+		n       NetworkConfig
+		wantErr string // substring of the expected error, or "" for success.
+	}{
+		{"system roots", NetworkConfig{}, formatFingerprint(sum[:])},
+		{"custom CA", NetworkConfig{TLSCA: caPath}, ""},
+		{"pinned", NetworkConfig{TLSFingerprint: hex.EncodeToString(sum[:])}, ""},
+		{"pin mismatch", NetworkConfig{TLSFingerprint: hex.EncodeToString(other[:])}, "mismatch: the server presented SHA-256 fingerprint " + formatFingerprint(sum[:])},
+		{"pin mismatch with CA", NetworkConfig{TLSCA: caPath, TLSFingerprint: hex.EncodeToString(other[:])}, "mismatch"},
+		{"insecure", NetworkConfig{TLSInsecure: true}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, _ := listenTLS(t, &tls.Config{
+				Certificates: []tls.Certificate{server},
+			})
+			n := test.n
+			n.Addr = addr
+			n.Nick = "senpai"
+			n.TLS = true
+			if err := n.check(); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := tryConnect(n)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				conn.Close()
+				return
+			}
+			if err == nil {
+				conn.Close()
+				t.Fatal("expected the server certificate to be rejected")
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("expected error to contain %q, got %q", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestParseFingerprint(t *testing.T) {
+	sum := sha256.Sum256([]byte("senpai"))
+	fp, err := parseFingerprint(formatFingerprint(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected %q, got %q", hex.EncodeToString(sum[:]), fp)
+	}
+	if _, err := parseFingerprint("abcd"); err == nil {
+		t.Error("expected a short fingerprint to be rejected")
+	}
+}
+
+func TestSTSUpgrade(t *testing.T) {
+	app := &App{stsPolicies: map[string]STSPolicy{}}
+	n := NetworkConfig{Addr: "irc.example.org"}
+
+	if c := app.stsUpgrade(n); c.TLS {
+		t.Fatal("expected no upgrade without a policy")
+	}
+
+	app.setSTSPolicy("IRC.example.org", STSPolicy{Port: 6697})
+	c := app.stsUpgrade(n)
+	if !c.TLS || c.Addr != "irc.example.org:6697" {
+		t.Errorf("expected a TLS connection to irc.example.org:6697, got %q (TLS: %t)", c.Addr, c.TLS)
+	}
+	if len(app.STSPolicies()) != 0 {
+		t.Error("expected unconfirmed policies not to be persisted")
+	}
+
+	app.setSTSPolicy("irc.example.org", STSPolicy{Port: 7000, Expiry: time.Now().Add(time.Hour)})
+	if c := app.stsUpgrade(n); c.Addr != "irc.example.org:7000" {
+		t.Errorf("expected irc.example.org:7000, got %q", c.Addr)
+	}
+	if len(app.STSPolicies()) != 1 {
+		t.Error("expected the confirmed policy to be persisted")
+	}
+
+	app.setSTSPolicy("irc.example.org", STSPolicy{Port: 7000, Expiry: time.Now().Add(-time.Hour)})
+	if c := app.stsUpgrade(n); c.TLS {
+		t.Error("expected no upgrade with an expired policy")
+	}
+}
+
+func TestSTSWebsocket(t *testing.T) {
+	app := &App{
+		stsPolicies: map[string]STSPolicy{},
+		connections: map[string]connection{
+			"": {host: "irc.example.org", port: 80, websocket: true},
+		},
+	}
+	app.handleSTS("", irc.STSPolicy{Port: 6697})
+	if len(app.stsPolicies) != 0 {
+		t.Errorf("expected STS policies advertised over WebSocket to be ignored")
+	}
+}
+
+func TestAddress(t *testing.T) {
+	tests := []struct {
+		addr     string
+		tls      bool
+		expected string
+	}{
+		{"irc.example.org", true, "irc.example.org:6697"},
+		{"irc.example.org", false, "irc.example.org:6667"},
+		{"irc.example.org:7000", true, "irc.example.org:7000"},
+		{"[::1]", true, "[::1]:6697"},
+		{"wss://irc.example.org/socket", false, "irc.example.org:443"},
+		{"ws://irc.example.org/socket", true, "irc.example.org:80"},
+		{"ws://[::1]:8080/", false, "[::1]:8080"},
+	}
+	for _, test := range tests {
+		n := NetworkConfig{Addr: test.addr, TLS: test.tls}
+		if actual := address(n); actual != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.addr, test.expected, actual)
+		}
+	}
+
+	n := NetworkConfig{Addr: "ws://irc.example.org/socket", Nick: "senpai", TLS: true}
+	if err := n.check(); err != nil {
+		t.Fatal(err)
+	}
+	if n.TLS {
+		t.Error("expected ws:// not to use TLS")
+	}
+}
+
+func TestBoundCompare(t *testing.T) {
+	t0 := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	line := func(id string, ms int, body string) ui.Line {
+		return ui.Line{
+			ID:   id,
+			At:   t0.Add(time.Duration(ms) * time.Millisecond),
+			Body: ui.PlainString(body),
+		}
+	}
+
+	var b bound
+	for _, l := range []ui.Line{
+		line("a", 100, "hello"),
+		line("b", 200, "hello"),
+		line("c", 300, "world"),
+	} {
+		b.Update(&l)
+	}
+
+	tests := []struct {
+		line     ui.Line
+		expected int
+	}{
+		// Known IDs are duplicates, wherever they are.
+		{line("a", 100, "hello"), 0},
+		{line("c", 900, "world"), 0},
+		// Unknown IDs in the same second are new.
+		{line("d", 50, "hello"), -1},
+		{line("e", 300, "world"), 1},
+		{line("f", 400, "hello"), 1},
+		// Without IDs, the second and content are compared.
+		{line("", -500, "hello"), -1},
+		{line("", 200, "other"), -1},
+		{line("", 1500, "other"), 1},
+	}
+	for _, test := range tests {
+		if c := b.Compare(&test.line); c != test.expected {
+			t.Errorf("%q at %s: expected %d, got %d", test.line.ID, test.line.At.Format("15:04:05.000"), test.expected, c)
+		}
+	}
+
+	// Within bounds, only lines with a known ID have been added.
+	for _, test := range []struct {
+		line     ui.Line
+		expected bool
+	}{
+		{line("b", 200, "hello"), true},
+		{line("g", 250, "gap"), false},
+		{line("", 200, "hello"), true},
+	} {
+		if has := b.Has(&test.line); has != test.expected {
+			t.Errorf("%q at %s: expected Has to be %t", test.line.ID, test.line.At.Format("15:04:05.000"), test.expected)
+		}
+	}
+
+	// The oldest IDs are forgotten, and their lines assumed to be added.
+	for i := 0; i <= maxBoundIDs; i++ {
+		l := line(fmt.Sprintf("id%d", i), 1000+i, "hello")
+		b.Update(&l)
+	}
+	if maxBoundIDs < len(b.ids) {
+		t.Errorf("expected at most %d IDs, got %d", maxBoundIDs, len(b.ids))
+	}
+	if l := line("g", 250, "gap"); !b.Has(&l) {
+		t.Errorf("expected lines older than the forgotten IDs to be assumed added")
+	}
+	if l := line("h", 1000+maxBoundIDs-1, "gap"); b.Has(&l) {
+		t.Errorf("expected a recent unknown ID not to be added")
+	}
+}
+
+func TestDescribeModeChange(t *testing.T) {
+	tests := []struct {
+		ev       irc.ModeChangeEvent
+		expected string
+	}{
+		{irc.ModeChangeEvent{
+			User: "alice",
+			Mode: "+o-v bob bob",
+			Changes: []irc.ModeChange{
+				{Enable: true, Mode: 'o', Param: "bob", Membership: true},
+				{Enable: false, Mode: 'v', Param: "bob", Membership: true},
+			},
+		}, "alice gave operator status to bob, removed voice status from bob"},
+		{irc.ModeChangeEvent{
+			User:    "alice",
+			Mode:    "+kX hunter2",
+			Changes: []irc.ModeChange{{Enable: true, Mode: 'k', Param: "hunter2"}, {Enable: true, Mode: 'X'}},
+		}, "alice set the channel key, set mode +X"},
+		{irc.ModeChangeEvent{Mode: "+i"}, "[+i]"},
+	}
+
+	// On servers where q is the quiet list, rather than the owner status.
+	chanmodes := [4]string{"eIbq", "k", "flj", "CFLMPQScgimnprstuz"}
+	for _, mode := range []string{"+q", "-q"} {
+		changes, err := irc.ParseChannelMode(mode, []string{"*!*@example.org"}, chanmodes, "ov")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "alice quieted *!*@example.org"
+		if mode == "-q" {
+			expected = "alice removed the quiet on *!*@example.org"
+		}
+		tests = append(tests, struct {
+			ev       irc.ModeChangeEvent
+			expected string
+		}{irc.ModeChangeEvent{User: "alice", Mode: mode + " *!*@example.org", Changes: changes}, expected})
+	}
+	changes, err := irc.ParseChannelMode("+q", []string{"bob"}, [4]string{"beI", "k", "l", "imnst"}, "qaohv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests = append(tests, struct {
+		ev       irc.ModeChangeEvent
+		expected string
+	}{irc.ModeChangeEvent{User: "alice", Mode: "+q bob", Changes: changes}, "alice gave owner status to bob"})
+
+	for _, test := range tests {
+		if d := describeModeChange(test.ev); d != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, d)
+		}
+	}
+}
+
+func TestBanMask(t *testing.T) {
+	out := make(chan irc.Message, 64)
+	s := irc.NewSession(out, irc.SessionParams{Nickname: "senpai"})
+	defer s.Close()
+	for _, line := range []string{
+		":irc.example.org 001 senpai :Welcome",
+		":senpai!senpai@example.org JOIN #senpai",
+		":kouhai!~kou@kouhai.example.org JOIN #senpai",
+	} {
+		msg, err := irc.ParseMessage(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.HandleMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		style    string
+		nick     string
+		expected string
+	}{
+		{"host", "kouhai", "*!*@kouhai.example.org"},
+		{"user", "kouhai", "*!*kou@kouhai.example.org"},
+		{"nick", "kouhai", "kouhai!*@*"},
+		{"full", "kouhai", "kouhai!~kou@kouhai.example.org"},
+		{"host", "stranger", "stranger!*@*"},
+		{"host", "*!*@bad.example.org", "*!*@bad.example.org"},
+	}
+	for _, test := range tests {
+		app := &App{cfg: Config{BanMask: test.style}}
+		if mask := app.banMask(s, test.nick); mask != test.expected {
+			t.Errorf("%s %s: expected %q, got %q", test.style, test.nick, test.expected, mask)
+		}
+	}
+}
+
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		mask     string
+		name     string
+		expected bool
+	}{
+		{"*", "#senpai", true},
+		{"#senpai", "#senpai", true},
+		{"#senpai", "#senpai-dev", false},
+		{"*senpai*", "#senpai-dev", true},
+		{"#sen?ai", "#senpai", true},
+		{"#sen?ai", "#senai", false},
+		{"#*-dev", "#senpai", false},
+	}
+	for _, test := range tests {
+		if matchMask(test.mask, test.name) != test.expected {
+			t.Errorf("expected %q matching %q to be %v", test.mask, test.name, test.expected)
+		}
+	}
+}
+
+func TestRestoreAway(t *testing.T) {
+	tests := []struct {
+		awayMessage string
+		autoAway    bool
+		expected    string
+	}{
+		{"", false, ""},
+		{"", true, "AWAY Idle"},
+		{"Lunch", false, "AWAY Lunch"},
+		{"Lunch", true, "AWAY Lunch"},
+	}
+	for _, test := range tests {
+		out := make(chan irc.Message, 64)
+		s := irc.NewSession(out, irc.SessionParams{Nickname: "senpai"})
+		for len(out) != 0 {
+			<-out // registration
+		}
+		app := &App{
+			cfg:         Config{AutoAwayMessage: "Idle"},
+			autoAway:    map[string]struct{}{},
+			awayMessage: test.awayMessage,
+		}
+		if test.autoAway {
+			app.autoAway["net"] = struct{}{}
+		}
+		app.restoreAway("net", s)
+		var sent string
+		if len(out) != 0 {
+			msg := <-out
+			sent = msg.String()
+		}
+		if sent != test.expected {
+			t.Errorf("%q %v: expected %q, got %q", test.awayMessage, test.autoAway, test.expected, sent)
+		}
+		s.Close()
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -48,6 +49,7 @@ func main() {
 	lastNetID, lastBuffer := getLastBuffer()
 	app.SwitchToBuffer(lastNetID, lastBuffer)
 	app.SetLastClose(getLastStamp())
+	app.SetSTSPolicies(getSTSPolicies())
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
@@ -59,8 +61,10 @@ func main() {
 
 	app.Run()
 	app.Close()
+	app.WaitSent(5 * time.Second)
 	writeLastBuffer(app)
 	writeLastStamp(app)
+	writeSTSPolicies(app)
 }
 
 func cachePath() string {
@@ -131,3 +135,47 @@ func writeLastStamp(app *senpai.App) {
 		fmt.Fprintf(os.Stderr, "failed to write last stamp at %q: %s\n", lastStampPath, err)
 	}
 }
+
+func stsPath() string {
+	return path.Join(cachePath(), "sts.txt")
+}
+
+func getSTSPolicies() map[string]senpai.STSPolicy {
+	policies := map[string]senpai.STSPolicy{}
+	buf, err := ioutil.ReadFile(stsPath())
+	if err != nil {
+		return policies
+	}
+
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		port, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		expiry, err := time.Parse(time.RFC3339, fields[2])
+		if err != nil {
+			continue
+		}
+		policies[fields[0]] = senpai.STSPolicy{
+			Port:   port,
+			Expiry: expiry,
+		}
+	}
+	return policies
+}
+
+func writeSTSPolicies(app *senpai.App) {
+	stsPath := stsPath()
+	var sb strings.Builder
+	for host, policy := range app.STSPolicies() {
+		fmt.Fprintf(&sb, "%s %d %s\n", host, policy.Port, policy.Expiry.Format(time.RFC3339))
+	}
+	err := os.WriteFile(stsPath, []byte(sb.String()), 0666)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write STS policies at %q: %s\n", stsPath, err)
+	}
+}
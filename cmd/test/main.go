@@ -52,12 +52,15 @@ func main() {
 
 	fmt.Fprintf(t, "Connected. Registration in progress...\n")
 
-	var auth irc.SASLClient
+	var auths []irc.SASLClient
 	if password != "" {
-		auth = &irc.SASLPlain{Username: nick, Password: password}
+		auths = []irc.SASLClient{
+			&irc.SASLScram{Username: nick, Password: password},
+			&irc.SASLPlain{Username: nick, Password: password},
+		}
 	}
 
-	in, out := irc.ChanInOut(conn)
+	in, out, _ := irc.ChanInOut(conn, irc.FloodControl{})
 	debugOut := make(chan irc.Message, 64)
 	go func() {
 		for msg := range debugOut {
@@ -71,7 +74,7 @@ func main() {
 		Nickname: nick,
 		Username: nick,
 		RealName: nick,
-		Auth:     auth,
+		Auths:    auths,
 	})
 	defer cli.Close()
 
@@ -116,11 +119,15 @@ func parseFlags() {
 			panic(err)
 		}
 
-		address = cfg.Addr
-		nick = cfg.Nick
-		if cfg.Password != nil {
-			password = *cfg.Password
+		n := cfg.NetworkConfig
+		if n.Addr == "" {
+			n = cfg.Networks[0]
+		}
+		address = n.Addr
+		nick = n.Nick
+		if n.Password != nil {
+			password = *n.Password
 		}
-		useTLS = cfg.TLS
+		useTLS = n.TLS
 	}
 }
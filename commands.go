@@ -16,6 +16,9 @@ var (
 	errOffline = fmt.Errorf("you are disconnected from the server, retry later")
 )
 
+// defaultAwayMessage is used when marking ourselves away without a message.
+const defaultAwayMessage = "Away"
+
 type command struct {
 	AllowHome bool
 	MinArgs   int
@@ -31,6 +34,21 @@ var commands commandSet
 
 func init() {
 	commands = commandSet{
+		"CTCP": {
+			AllowHome: true,
+			MinArgs:   2,
+			MaxArgs:   3,
+			Usage:     "<nick> <command> [params]",
+			Desc:      "send a CTCP request, such as VERSION or PING",
+			Handle:    commandDoCTCP,
+		},
+		"EXCEPTLIST": {
+			AllowHome: true,
+			MaxArgs:   1,
+			Usage:     "[channel]",
+			Desc:      "show and edit the ban exception list of a channel",
+			Handle:    commandDoModeList('e'),
+		},
 		"HELP": {
 			AllowHome: true,
 			MaxArgs:   1,
@@ -38,6 +56,13 @@ func init() {
 			Desc:      "show the list of commands, or how to use the given one",
 			Handle:    commandDoHelp,
 		},
+		"INVEXLIST": {
+			AllowHome: true,
+			MaxArgs:   1,
+			Usage:     "[channel]",
+			Desc:      "show and edit the invite exception list of a channel",
+			Handle:    commandDoModeList('I'),
+		},
 		"JOIN": {
 			AllowHome: true,
 			MinArgs:   1,
@@ -46,6 +71,13 @@ func init() {
 			Desc:      "join a channel",
 			Handle:    commandDoJoin,
 		},
+		"LIST": {
+			AllowHome: true,
+			MaxArgs:   1,
+			Usage:     "[filter]",
+			Desc:      "browse the channels of the server",
+			Handle:    commandDoList,
+		},
 		"ME": {
 			AllowHome: true,
 			MinArgs:   1,
@@ -62,6 +94,14 @@ func init() {
 			Desc:      "send a message to the given target",
 			Handle:    commandDoMsg,
 		},
+		"MONITOR": {
+			AllowHome: true,
+			MinArgs:   1,
+			MaxArgs:   2,
+			Usage:     "add|del|list [nicks]",
+			Desc:      "know when the given users come online or go offline",
+			Handle:    commandDoMonitor,
+		},
 		"NAMES": {
 			Desc:   "show the member list of the current channel",
 			Handle: commandDoNames,
@@ -120,12 +160,59 @@ func init() {
 			Desc:      "reply to the last query",
 			Handle:    commandDoR,
 		},
+		"REACT": {
+			MinArgs: 1,
+			MaxArgs: 2,
+			Usage:   "[nick] <reaction>",
+			Desc:    "react to the last message, or to the last message of nick",
+			Handle:  commandDoReact,
+		},
+		"RESPOND": {
+			MinArgs: 2,
+			MaxArgs: 2,
+			Usage:   "<nick> <message>",
+			Desc:    "reply to the last message of nick, quoting it",
+			Handle:  commandDoRespond,
+		},
+		"REDACT": {
+			MaxArgs: 1,
+			Usage:   "[reason]",
+			Desc:    "delete your last message in the current buffer",
+			Handle:  commandDoRedact,
+		},
+		"SETNAME": {
+			AllowHome: true,
+			MinArgs:   1,
+			MaxArgs:   1,
+			Usage:     "<realname>",
+			Desc:      "change your realname",
+			Handle:    commandDoSetname,
+		},
 		"TOPIC": {
 			MaxArgs: 1,
 			Usage:   "[topic]",
 			Desc:    "show or set the topic of the current channel",
 			Handle:  commandDoTopic,
 		},
+		"AWAY": {
+			AllowHome: true,
+			MaxArgs:   1,
+			Usage:     "[message]",
+			Desc:      "mark yourself as being away on all networks",
+			Handle:    commandDoAway,
+		},
+		"BACK": {
+			AllowHome: true,
+			Desc:      "mark yourself as being back on all networks",
+			Handle:    commandDoBack,
+		},
+		"BANLIST": {
+			AllowHome: true,
+			MaxArgs:   1,
+			Usage:     "[channel]",
+			Desc:      "show and edit the ban list of a channel",
+			Handle:    commandDoModeList('b'),
+		},
 		"BUFFER": {
 			AllowHome: true,
 			MinArgs:   1,
@@ -158,6 +245,60 @@ func init() {
 			Desc:      "ban someone from entering the channel",
 			Handle:    commandDoBan,
 		},
+		"RECONNECT": {
+			AllowHome: true,
+			Desc:      "reconnect to the server of the current buffer now",
+			Handle:    commandDoReconnect,
+		},
+		"OP": {
+			MinArgs: 1,
+			MaxArgs: 1,
+			Usage:   "[channel] <nicks>",
+			Desc:    "give operator status to the given users",
+			Handle:  commandDoMemberMode(true, 'o'),
+		},
+		"DEOP": {
+			MinArgs: 1,
+			MaxArgs: 1,
+			Usage:   "[channel] <nicks>",
+			Desc:    "remove operator status from the given users",
+			Handle:  commandDoMemberMode(false, 'o'),
+		},
+		"VOICE": {
+			MinArgs: 1,
+			MaxArgs: 1,
+			Usage:   "[channel] <nicks>",
+			Desc:    "give voice to the given users",
+			Handle:  commandDoMemberMode(true, 'v'),
+		},
+		"DEVOICE": {
+			MinArgs: 1,
+			MaxArgs: 1,
+			Usage:   "[channel] <nicks>",
+			Desc:    "remove voice from the given users",
+			Handle:  commandDoMemberMode(false, 'v'),
+		},
+		"KICKBAN": {
+			MinArgs: 1,
+			MaxArgs: 1,
+			Usage:   "[channel] <nicks> [:reason]",
+			Desc:    "ban the given users and eject them from the channel",
+			Handle:  commandDoKickban,
+		},
+		"QUIET": {
+			MinArgs: 1,
+			MaxArgs: 1,
+			Usage:   "[channel] <nicks>",
+			Desc:    "prevent the given users from talking in the channel",
+			Handle:  commandDoQuiet,
+		},
+		"DISCONNECT": {
+			AllowHome: true,
+			MaxArgs:   1,
+			Usage:     "[reason]",
+			Desc:      "disconnect from the server of the current buffer until /reconnect",
+			Handle:    commandDoDisconnect,
+		},
 		"UNBAN": {
 			AllowHome: false,
 			MinArgs:   1,
@@ -166,6 +307,13 @@ func init() {
 			Desc:      "remove effect of a ban from the user",
 			Handle:    commandDoUnban,
 		},
+		"WHOIS": {
+			AllowHome: true,
+			MaxArgs:   1,
+			Usage:     "[nick]",
+			Desc:      "show information about a user (the one of the query if omitted)",
+			Handle:    commandDoWhois,
+		},
 	}
 }
 
@@ -210,6 +358,24 @@ func commandDoBuffer(app *App, args []string) error {
 	return nil
 }
 
+func commandDoCTCP(app *App, args []string) (err error) {
+	netID, _ := app.win.CurrentBuffer()
+	s := app.sessions[netID]
+	if s == nil {
+		return errOffline
+	}
+	command := strings.ToUpper(args[1])
+	params := ""
+	if len(args) == 3 {
+		params = args[2]
+	} else if command == "PING" {
+		// Measure the round-trip time from the reply.
+		params = strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	s.CTCP(args[0], command, params)
+	return nil
+}
+
 func commandDoHelp(app *App, args []string) (err error) {
 	t := time.Now()
 	netID, buffer := app.win.CurrentBuffer()
@@ -296,6 +462,68 @@ func commandDoJoin(app *App, args []string) (err error) {
 	return nil
 }
 
+// isNumber returns whether s is made of decimal digits only.
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || '9' < r {
+			return false
+		}
+	}
+	return true
+}
+
+func commandDoList(app *App, args []string) (err error) {
+	netID, _ := app.win.CurrentBuffer()
+	s := app.sessions[netID]
+	if s == nil {
+		return errOffline
+	}
+	list := shownList{netID: netID, maxUsers: -1}
+	var conditions, search []string
+	if len(args) == 1 {
+		for _, word := range strings.Fields(args[0]) {
+			switch {
+			case (word[0] == '<' || word[0] == '>') && isNumber(word[1:]):
+				if s.HasListCondition('U') {
+					conditions = append(conditions, word)
+					break
+				}
+				n, _ := strconv.Atoi(word[1:])
+				if word[0] == '>' {
+					list.minUsers = n + 1
+				} else {
+					list.maxUsers = n - 1
+				}
+			case (word[0] == 'C' || word[0] == 'T') && 2 < len(word) && (word[1] == '<' || word[1] == '>') && isNumber(word[2:]):
+				if !s.HasListCondition(word[0]) {
+					return fmt.Errorf("the server does not support the %s condition", word)
+				}
+				conditions = append(conditions, word)
+			case strings.ContainsAny(word, "*?"):
+				if (word[0] == '!' && s.HasListCondition('N')) || (word[0] != '!' && s.HasListCondition('M')) {
+					conditions = append(conditions, word)
+				} else {
+					list.masks = append(list.masks, word)
+				}
+			default:
+				search = append(search, word)
+			}
+		}
+	}
+
+	help := "Type to search, Enter to join the selected channel, Alt-S to sort, Escape to close"
+	view := ui.NewList(channelListTitle(0, false), help, []string{"Channel", "Users", "Topic"}, nil)
+	view.Search(strings.Join(search, " "))
+	app.list = list
+	app.channelLists[netID] = nil
+	app.win.OpenList(view)
+	s.List(conditions...)
+	return nil
+}
+
 func commandDoMe(app *App, args []string) (err error) {
 	netID, buffer := app.win.CurrentBuffer()
 	if buffer == "" {
@@ -349,6 +577,73 @@ func commandDoMsg(app *App, args []string) (err error) {
 	return nil
 }
 
+func commandDoMonitor(app *App, args []string) (err error) {
+	netID, buffer := app.win.CurrentBuffer()
+	s := app.sessions[netID]
+	if s == nil {
+		return errOffline
+	}
+	if !s.HasMonitor() {
+		return fmt.Errorf("the server does not support monitoring users")
+	}
+
+	var nicks []string
+	if len(args) == 2 {
+		nicks = strings.FieldsFunc(args[1], func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "add":
+		if len(nicks) == 0 {
+			return fmt.Errorf("usage: MONITOR add <nicks>")
+		}
+		err = s.Monitor(nicks...)
+	case "del":
+		if len(nicks) == 0 {
+			return fmt.Errorf("usage: MONITOR del <nicks>")
+		}
+		s.Unmonitor(nicks...)
+	case "list":
+		var sb ui.StyledStringBuilder
+		sb.SetStyle(tcell.StyleDefault.Foreground(tcell.ColorGrey))
+		sb.WriteString("Monitored:")
+		for _, e := range s.Monitored() {
+			sb.SetStyle(tcell.StyleDefault)
+			sb.WriteByte(' ')
+			sb.WriteString(e.Nick)
+			if e.Known {
+				if e.Online {
+					sb.SetStyle(tcell.StyleDefault.Foreground(tcell.ColorGreen))
+					sb.WriteString(" (online)")
+				} else {
+					sb.SetStyle(tcell.StyleDefault.Foreground(tcell.ColorGrey))
+					sb.WriteString(" (offline)")
+				}
+			}
+		}
+		app.win.AddLine(netID, buffer, ui.NotifyNone, ui.Line{
+			At:        time.Now(),
+			Head:      "--",
+			HeadColor: tcell.ColorGray,
+			Body:      sb.StyledString(),
+		})
+		return nil
+	default:
+		return fmt.Errorf("usage: MONITOR add|del|list [nicks]")
+	}
+
+	// Keep the list across reconnections.
+	n := app.networks[netID]
+	n.Monitor = nil
+	for _, e := range s.Monitored() {
+		n.Monitor = append(n.Monitor, e.Nick)
+	}
+	app.networks[netID] = n
+	return err
+}
+
 func commandDoNames(app *App, args []string) (err error) {
 	netID, buffer := app.win.CurrentBuffer()
 	s := app.sessions[netID]
@@ -394,6 +689,14 @@ func commandDoNick(app *App, args []string) (err error) {
 	return
 }
 
+func commandDoSetname(app *App, args []string) (err error) {
+	s := app.CurrentSession()
+	if s == nil {
+		return errOffline
+	}
+	return s.SetRealName(args[0])
+}
+
 func commandDoMode(app *App, args []string) (err error) {
 	if strings.HasPrefix(args[0], "+") || strings.HasPrefix(args[0], "-") {
 		// if we do eg /MODE +P, automatically insert the current channel: /MODE #<current-chan> +P
@@ -434,10 +737,12 @@ func commandDoPart(app *App, args []string) (err error) {
 		return fmt.Errorf("cannot part this buffer")
 	}
 
-	if s.IsChannel(channel) {
+	if s.IsJoined(channel) {
 		s.Part(channel, reason)
 	} else {
+		// Queries, and channels we have been kicked from.
 		app.win.RemoveBuffer(netID, channel)
+		delete(app.messageBounds, boundKey{netID, channel})
 	}
 	return nil
 }
@@ -496,6 +801,99 @@ func commandDoR(app *App, args []string) (err error) {
 	return nil
 }
 
+// lastMessage returns the last message of the given buffer that can be replied
+// or reacted to, sent by nick, or by anyone but us if nick is empty.
+func (app *App) lastMessage(s *irc.Session, netID, buffer, nick string) (ev irc.MessageEvent, ok bool) {
+	nickCf := s.Casemap(nick)
+	line, ok := app.win.FindLine(netID, buffer, func(line *ui.Line) bool {
+		if line.ID == "" || len(line.Data) == 0 {
+			return false
+		}
+		ev, ok := line.Data[0].(irc.MessageEvent)
+		if !ok {
+			return false
+		}
+		if nick == "" {
+			return !s.IsMe(ev.User)
+		}
+		return s.Casemap(ev.User) == nickCf
+	})
+	if !ok {
+		return ev, false
+	}
+	return line.Data[0].(irc.MessageEvent), true
+}
+
+func commandDoReact(app *App, args []string) (err error) {
+	netID, buffer := app.win.CurrentBuffer()
+	s := app.sessions[netID]
+	if s == nil {
+		return errOffline
+	}
+	nick := ""
+	reaction := args[0]
+	if len(args) == 2 {
+		nick = args[0]
+		reaction = args[1]
+	}
+	ev, ok := app.lastMessage(s, netID, buffer, nick)
+	if !ok {
+		return fmt.Errorf("there is no message to react to")
+	}
+	if err := s.React(buffer, ev.ID, reaction); err != nil {
+		return err
+	}
+	if !s.HasCapability("echo-message") {
+		app.win.AddReaction(netID, buffer, ev.ID, s.Nick(), reaction)
+	}
+	return nil
+}
+
+func commandDoRedact(app *App, args []string) (err error) {
+	netID, buffer := app.win.CurrentBuffer()
+	s := app.sessions[netID]
+	if s == nil {
+		return errOffline
+	}
+	reason := ""
+	if len(args) != 0 {
+		reason = args[0]
+	}
+	ev, ok := app.lastMessage(s, netID, buffer, s.Nick())
+	if !ok {
+		return fmt.Errorf("there is no message of yours to delete")
+	}
+	// Our own messages only have an ID with echo-message, in which case
+	// the server echoes the REDACT as well.
+	return s.Redact(buffer, ev.ID, reason)
+}
+
+func commandDoRespond(app *App, args []string) (err error) {
+	netID, buffer := app.win.CurrentBuffer()
+	s := app.sessions[netID]
+	if s == nil {
+		return errOffline
+	}
+	ev, ok := app.lastMessage(s, netID, buffer, args[0])
+	if !ok {
+		return fmt.Errorf("there is no message from %s to reply to", args[0])
+	}
+	s.Reply(buffer, ev.ID, args[1])
+	if !s.HasCapability("echo-message") {
+		_, line, _ := app.formatMessage(s, irc.MessageEvent{
+			User:            s.Nick(),
+			Target:          buffer,
+			TargetIsChannel: s.IsChannel(buffer),
+			Command:         "PRIVMSG",
+			Content:         args[1],
+			Time:            time.Now(),
+			ReplyTo:         ev.ID,
+		})
+		app.win.AddLine(netID, buffer, ui.NotifyNone, line)
+	}
+	return nil
+}
+
 func commandDoTopic(app *App, args []string) (err error) {
 	netID, buffer := app.win.CurrentBuffer()
 	var ok bool
@@ -582,6 +980,218 @@ func commandDoUnban(app *App, args []string) (err error) {
 	return nil
 }
 
+// commandDoModeList returns the handler of the command that shows the list of
+// the given channel mode.
+func commandDoModeList(mode byte) func(app *App, args []string) error {
+	return func(app *App, args []string) error {
+		netID, channel := app.win.CurrentBuffer()
+		s := app.sessions[netID]
+		if s == nil {
+			return errOffline
+		}
+		if len(args) == 1 {
+			channel = args[0]
+		}
+		if !s.IsChannel(channel) {
+			return fmt.Errorf("either send this command from a channel, or specify the channel")
+		}
+		if !s.HasListMode(mode) {
+			return fmt.Errorf("the server does not support this list")
+		}
+		s.RequestModeList(channel, mode)
+		return nil
+	}
+}
+
+// banMaskStyles are the ways ban masks can be made from a nickname, given
+// its user and host.
+var banMaskStyles = map[string]func(nick, user, host string) string{
+	"host": func(nick, user, host string) string {
+		return "*!*@" + host
+	},
+	"user": func(nick, user, host string) string {
+		return "*!*" + strings.TrimPrefix(user, "~") + "@" + host
+	},
+	"nick": func(nick, user, host string) string {
+		return nick + "!*@*"
+	},
+	"full": func(nick, user, host string) string {
+		return nick + "!" + user + "@" + host
+	},
+}
+
+// banMask returns the mask to ban nick with, according to the ban-mask
+// setting.  Masks are returned as is, and nicks whose host is unknown are
+// banned by nick.
+func (app *App) banMask(s *irc.Session, nick string) string {
+	if isMask(nick) {
+		return nick
+	}
+	p, ok := s.UserPrefix(nick)
+	if !ok || p.User == "" || p.Host == "" {
+		return nick + "!*@*"
+	}
+	style, ok := banMaskStyles[app.cfg.BanMask]
+	if !ok {
+		style = banMaskStyles["host"]
+	}
+	return style(p.Name, p.User, p.Host)
+}
+
+// isMask reports whether arg is a mask or an extban, rather than a nick.
+func isMask(arg string) bool {
+	return strings.ContainsAny(arg, "!@$:")
+}
+
+// channelNicks splits the arguments of commands taking an optional channel
+// followed by nicks.  The channel defaults to the current buffer.
+func (app *App) channelNicks(args []string) (s *irc.Session, channel string, nicks []string, err error) {
+	netID, channel := app.win.CurrentBuffer()
+	s = app.sessions[netID]
+	if s == nil {
+		return nil, "", nil, errOffline
+	}
+	nicks = strings.Fields(args[0])
+	if 0 < len(nicks) && s.IsChannel(nicks[0]) {
+		channel = nicks[0]
+		nicks = nicks[1:]
+	}
+	if len(nicks) == 0 {
+		return nil, "", nil, fmt.Errorf("no nick given")
+	}
+	if !s.IsChannel(channel) {
+		return nil, "", nil, fmt.Errorf("either send this command from a channel, or specify the channel")
+	}
+	return s, channel, nicks, nil
+}
+
+// commandDoMemberMode returns the handler of the command that gives (or
+// removes) the given membership mode to users.
+func commandDoMemberMode(enable bool, mode byte) func(app *App, args []string) error {
+	return func(app *App, args []string) error {
+		s, channel, nicks, err := app.channelNicks(args)
+		if err != nil {
+			return err
+		}
+		changes := make([]irc.ModeChange, 0, len(nicks))
+		for _, nick := range nicks {
+			changes = append(changes, irc.ModeChange{Enable: enable, Mode: mode, Param: nick})
+		}
+		s.ChangeModes(channel, changes)
+		return nil
+	}
+}
+
+// splitTrailing splits arguments from the trailing text that follows them,
+// which starts with a colon, such as "alice bob :reason".
+func splitTrailing(args string) (before, trailing string) {
+	i := strings.Index(" "+args, " :")
+	if i < 0 {
+		return args, ""
+	}
+	return args[:i], strings.TrimSpace(args[i+1:])
+}
+
+func commandDoKickban(app *App, args []string) (err error) {
+	targets, reason := splitTrailing(args[0])
+	s, channel, nicks, err := app.channelNicks([]string{targets})
+	if err != nil {
+		return err
+	}
+	changes := make([]irc.ModeChange, 0, len(nicks))
+	for _, nick := range nicks {
+		changes = append(changes, irc.ModeChange{Enable: true, Mode: 'b', Param: app.banMask(s, nick)})
+	}
+	s.ChangeModes(channel, changes)
+	for _, nick := range nicks {
+		if !isMask(nick) {
+			s.Kick(nick, channel, reason)
+		}
+	}
+	return nil
+}
+
+func commandDoQuiet(app *App, args []string) (err error) {
+	s, channel, nicks, err := app.channelNicks(args)
+	if err != nil {
+		return err
+	}
+	if !s.HasListMode('q') {
+		return fmt.Errorf("the server does not support quiets")
+	}
+	changes := make([]irc.ModeChange, 0, len(nicks))
+	for _, nick := range nicks {
+		changes = append(changes, irc.ModeChange{Enable: true, Mode: 'q', Param: app.banMask(s, nick)})
+	}
+	s.ChangeModes(channel, changes)
+	return nil
+}
+
+func commandDoWhois(app *App, args []string) (err error) {
+	netID, nick := app.win.CurrentBuffer()
+	s := app.sessions[netID]
+	if s == nil {
+		return errOffline
+	}
+	if len(args) == 1 {
+		nick = args[0]
+	} else if nick == "" || s.IsChannel(nick) {
+		return fmt.Errorf("either send this command from a query, or specify the nick")
+	}
+	s.Whois(nick)
+	return nil
+}
+
+func commandDoAway(app *App, args []string) (err error) {
+	if len(app.sessions) == 0 {
+		return errOffline
+	}
+	message := defaultAwayMessage
+	if len(args) == 1 {
+		message = args[0]
+	}
+	app.awayMessage = message
+	for _, s := range app.sessions {
+		s.SetAway(message)
+	}
+	return nil
+}
+
+func commandDoBack(app *App, args []string) (err error) {
+	if len(app.sessions) == 0 {
+		return errOffline
+	}
+	app.awayMessage = ""
+	for _, s := range app.sessions {
+		s.SetAway("")
+	}
+	return nil
+}
+
+func commandDoReconnect(app *App, args []string) (err error) {
+	netID, _ := app.win.CurrentBuffer()
+	if _, ok := app.controls[netID]; !ok {
+		return fmt.Errorf("no server to reconnect to from this buffer")
+	}
+	app.closeSession(netID, "Reconnecting")
+	app.controlNetwork(netID, netReconnect)
+	return nil
+}
+
+func commandDoDisconnect(app *App, args []string) (err error) {
+	netID, _ := app.win.CurrentBuffer()
+	if _, ok := app.controls[netID]; !ok {
+		return fmt.Errorf("no server to disconnect from in this buffer")
+	}
+	reason := ""
+	if 0 < len(args) {
+		reason = args[0]
+	}
+	app.closeSession(netID, reason)
+	app.controlNetwork(netID, netDisconnect)
+	return nil
+}
+
 // implemented from https://golang.org/src/strings/strings.go?s=8055:8085#L310
 func fieldsN(s string, n int) []string {
 	s = strings.TrimSpace(s)
@@ -644,6 +1254,82 @@ func parseCommand(s string) (command, args string, isCommand bool) {
 	return strings.ToUpper(s[1:i]), strings.TrimLeft(s[i:], " "), true
 }
 
+// primaryCommands are the commands that abbreviations resolve to when they
+// could also mean commands added later, so that the abbreviations people are
+// used to keep working, such as /r for REPLY despite RECONNECT.
+var primaryCommands = map[string]struct{}{
+	"BAN":    {},
+	"BUFFER": {},
+	"HELP":   {},
+	"INVITE": {},
+	"JOIN":   {},
+	"KICK":   {},
+	"ME":     {},
+	"MODE":   {},
+	"MSG":    {},
+	"NAMES":  {},
+	"NICK":   {},
+	"PART":   {},
+	"QUERY":  {},
+	"QUIT":   {},
+	"QUOTE":  {},
+	"REPLY":  {},
+	"TOPIC":  {},
+	"UNBAN":  {},
+}
+
+// findCommand returns the name of the command that name is the start of.  A
+// command whose name is exactly name is chosen over longer ones, so that, for
+// example, "BAN" is not mistaken for "BANLIST".  Otherwise, if name is the
+// start of several commands, only one of which is primary, it is chosen.
+func findCommand(name string) (string, error) {
+	if _, ok := commands[name]; ok {
+		return name, nil
+	}
+	var matches, primary []string
+	for key := range commands {
+		if !strings.HasPrefix(key, name) {
+			continue
+		}
+		matches = append(matches, key)
+		if _, ok := primaryCommands[key]; ok {
+			primary = append(primary, key)
+		}
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("command %q doesn't exist", name)
+	}
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+	if len(primary) == 1 {
+		return primary[0], nil
+	}
+	sort.Strings(matches)
+	return "", fmt.Errorf("ambiguous command %q (could mean %v)", name, strings.Join(matches, ", "))
+}
+
+// commandArgs returns the name of the command being typed in text, however it
+// is abbreviated, and the index at which its arguments start.  name is empty
+// if text is not a command followed by a space.
+func commandArgs(text []rune) (name string, argsStart int) {
+	if len(text) < 2 || text[0] != '/' || text[1] == '/' {
+		return "", 0
+	}
+	i := 1
+	for i < len(text) && text[i] != ' ' {
+		i++
+	}
+	if i == len(text) {
+		return "", 0
+	}
+	name, err := findCommand(strings.ToUpper(string(text[1:i])))
+	if err != nil {
+		return "", 0
+	}
+	return name, i + 1
+}
+
 func (app *App) handleInput(buffer, content string) error {
 	if content == "" {
 		return nil
@@ -657,22 +1343,10 @@ func (app *App) handleInput(buffer, content string) error {
 		return fmt.Errorf("lone slash at the beginning")
 	}
 
-	var chosenCMDName string
-	var found bool
-	for key := range commands {
-		if !strings.HasPrefix(key, cmdName) {
-			continue
-		}
-		if found {
-			return fmt.Errorf("ambiguous command %q (could mean %v or %v)", cmdName, chosenCMDName, key)
-		}
-		chosenCMDName = key
-		found = true
+	chosenCMDName, err := findCommand(cmdName)
+	if err != nil {
+		return err
 	}
-	if !found {
-		return fmt.Errorf("command %q doesn't exist", cmdName)
-	}
-
 	cmd := commands[chosenCMDName]
 
 	var args []string
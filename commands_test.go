@@ -0,0 +1,109 @@
+package senpai
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"BAN", "BAN"},
+		{"BANL", "BANLIST"},
+		{"KICK", "KICK"},
+		{"KICKB", "KICKBAN"},
+		{"RECONN", "RECONNECT"},
+		// Abbreviations of the first commands still mean them.
+		{"R", "REPLY"},
+		{"RE", "REPLY"},
+		{"K", "KICK"},
+		{"KI", "KICK"},
+		{"KIC", "KICK"},
+		{"QUI", "QUIT"},
+		{"I", "INVITE"},
+		{"IN", "INVITE"},
+		{"INV", "INVITE"},
+		{"MO", "MODE"},
+		{"BA", "BAN"},
+		{"U", "UNBAN"},
+		{"T", "TOPIC"},
+	}
+	for _, test := range tests {
+		name, err := findCommand(test.name)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if name != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, name)
+		}
+	}
+
+	for _, name := range []string{"DE", "Q", "NOPE"} {
+		if _, err := findCommand(name); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// Any abbreviation that was not ambiguous among the first commands
+	// still resolves.
+	for primary := range primaryCommands {
+		for i := 1; i < len(primary); i++ {
+			abbrev := primary[:i]
+			unique := true
+			for other := range primaryCommands {
+				if other != primary && strings.HasPrefix(other, abbrev) {
+					unique = false
+				}
+			}
+			if !unique {
+				continue
+			}
+			if name, err := findCommand(abbrev); err != nil || name != primary {
+				t.Errorf("%s: expected %s, got %q (%v)", abbrev, primary, name, err)
+			}
+		}
+	}
+}
+
+func TestSplitTrailing(t *testing.T) {
+	tests := []struct {
+		args     string
+		before   string
+		trailing string
+	}{
+		{"alice bob", "alice bob", ""},
+		{"alice bob :stop flooding", "alice bob ", "stop flooding"},
+		{"#senpai alice:b :bye :)", "#senpai alice:b ", "bye :)"},
+		{":bye", "", "bye"},
+	}
+	for _, test := range tests {
+		before, trailing := splitTrailing(test.args)
+		if before != test.before || trailing != test.trailing {
+			t.Errorf("%q: expected %q and %q, got %q and %q", test.args, test.before, test.trailing, before, trailing)
+		}
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	tests := []struct {
+		text      string
+		name      string
+		argsStart int
+	}{
+		{"/op alice", "OP", 4},
+		{"/OP alice", "OP", 4},
+		{"/kickb alice", "KICKBAN", 7},
+		{"/j #senpai", "JOIN", 3},
+		{"/op", "", 0},
+		{"//op alice", "", 0},
+		{"/nope alice", "", 0},
+		{"op alice", "", 0},
+	}
+	for _, test := range tests {
+		name, argsStart := commandArgs([]rune(test.text))
+		if name != test.name || argsStart != test.argsStart {
+			t.Errorf("%q: expected %q at %d, got %q at %d", test.text, test.name, test.argsStart, name, argsStart)
+		}
+	}
+}
@@ -3,9 +3,82 @@ package senpai
 import (
 	"strings"
 
+	"git.sr.ht/~taiite/senpai/irc"
 	"git.sr.ht/~taiite/senpai/ui"
 )
 
+// memberCommands are the commands that take nicks of channel members, with
+// which members are worth completing.
+var memberCommands = map[string]func(m irc.Member) bool{
+	"OP":      func(m irc.Member) bool { return !strings.Contains(m.PowerLevel, "@") },
+	"DEOP":    func(m irc.Member) bool { return strings.Contains(m.PowerLevel, "@") },
+	"VOICE":   func(m irc.Member) bool { return !strings.Contains(m.PowerLevel, "+") },
+	"DEVOICE": func(m irc.Member) bool { return strings.Contains(m.PowerLevel, "+") },
+	"KICKBAN": func(m irc.Member) bool { return true },
+	"QUIET":   func(m irc.Member) bool { return true },
+}
+
+// memberCommand returns the filter of the member command text starts with, if
+// any, and the index at which its arguments start.
+func memberCommand(text []rune) (argsStart int, filter func(m irc.Member) bool) {
+	name, argsStart := commandArgs(text)
+	filter = memberCommands[name]
+	return argsStart, filter
+}
+
+// completionsMemberCommands completes the nicks given to member commands,
+// such as /op, leaving out the members already given or on which the command
+// would have no effect.
+func (app *App) completionsMemberCommands(cs []ui.Completion, cursorIdx int, text []rune) []ui.Completion {
+	argsStart, filter := memberCommand(text)
+	if filter == nil || cursorIdx < argsStart {
+		return cs
+	}
+	var start int
+	for start = cursorIdx - 1; argsStart <= start; start-- {
+		if text[start] == ' ' {
+			break
+		}
+	}
+	start++
+	word := text[start:cursorIdx]
+	if len(word) == 0 || word[0] == ':' {
+		return cs
+	}
+	if args := string(text[argsStart:start]); strings.Contains(" "+args, " :") {
+		// The nicks are over, this is the reason of /kickban.
+		return cs
+	}
+	netID, buffer := app.win.CurrentBuffer()
+	s := app.sessions[netID] // is not nil
+	given := map[string]struct{}{}
+	for _, nick := range strings.Fields(string(text[argsStart:])) {
+		given[s.Casemap(nick)] = struct{}{}
+	}
+	wordCf := s.Casemap(string(word))
+	for _, m := range s.Names(buffer) {
+		nickCf := s.Casemap(m.Name.Name)
+		if _, ok := given[nickCf]; ok && nickCf != wordCf {
+			continue
+		}
+		if !strings.HasPrefix(nickCf, wordCf) || !filter(m) {
+			continue
+		}
+		nickComp := append([]rune(m.Name.Name), ' ')
+		c := make([]rune, len(text)+len(nickComp)-len(word))
+		copy(c[:start], text[:start])
+		if cursorIdx < len(text) {
+			copy(c[start+len(nickComp):], text[cursorIdx:])
+		}
+		copy(c[start:], nickComp)
+		cs = append(cs, ui.Completion{
+			Text:      c,
+			CursorIdx: start + len(nickComp),
+		})
+	}
+	return cs
+}
+
 func (app *App) completionsChannelMembers(cs []ui.Completion, cursorIdx int, text []rune) []ui.Completion {
 	var start int
 	for start = cursorIdx - 1; 0 <= start; start-- {
@@ -99,6 +172,38 @@ func (app *App) completionsMsg(cs []ui.Completion, cursorIdx int, text []rune) [
 	return cs
 }
 
+// completionsJoin completes the channel given to /join with the channels
+// given by the last /list.
+func (app *App) completionsJoin(cs []ui.Completion, cursorIdx int, text []rune) []ui.Completion {
+	name, argsStart := commandArgs(text)
+	if name != "JOIN" || cursorIdx < argsStart {
+		return cs
+	}
+	netID, _ := app.win.CurrentBuffer()
+	s := app.sessions[netID] // is not nil
+	word := string(text[argsStart:cursorIdx])
+	if word == "" || strings.ContainsRune(word, ' ') {
+		return cs
+	}
+	wordCf := s.Casemap(word)
+	for _, channel := range app.channelLists[netID] {
+		if strings.HasPrefix(s.Casemap(channel), wordCf) {
+			chanComp := append([]rune(channel), ' ')
+			c := make([]rune, len(text)+argsStart+len(chanComp)-cursorIdx)
+			copy(c[:argsStart], text[:argsStart])
+			copy(c[argsStart:], chanComp)
+			if cursorIdx < len(text) {
+				copy(c[argsStart+len(chanComp):], text[cursorIdx:])
+			}
+			cs = append(cs, ui.Completion{
+				Text:      c,
+				CursorIdx: argsStart + len(chanComp),
+			})
+		}
+	}
+	return cs
+}
+
 func hasPrefix(s, prefix []rune) bool {
 	return len(prefix) <= len(s) && equal(prefix, s[:len(prefix)])
 }
@@ -1,17 +1,24 @@
 package senpai
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gdamore/tcell/v2"
 
 	"git.sr.ht/~emersion/go-scfg"
+	"git.sr.ht/~taiite/senpai/irc"
 )
 
 type Color tcell.Color
@@ -50,14 +57,33 @@ type ConfigColors struct {
 	Prompt Color
 }
 
-type Config struct {
+// NetworkConfig holds the settings needed to connect to an IRC server.
+type NetworkConfig struct {
+	Name     string // the name of the network, "" for the top-level one.
 	Addr     string
 	Nick     string
+	AltNicks []string // nicknames to try when Nick is taken, in order.
 	Real     string
 	User     string
 	Password *string
 	TLS      bool
 	Channels []string
+	Monitor  []string // nicks of the users to know when they are online.
+
+	TLSCert string // path to the client certificate, used for SASL EXTERNAL.
+	TLSKey  string // path to the private key of TLSCert, if not in TLSCert.
+
+	TLSCA          string // path to the CA bundle to trust instead of the system's.
+	TLSFingerprint string // SHA-256 fingerprint of the server certificate, in lowercase hex.
+	TLSInsecure    bool   // skip the verification of the server certificate.
+
+	Proxy string // URL of the SOCKS5 or HTTP proxy to connect through.
+}
+
+type Config struct {
+	NetworkConfig
+
+	Networks []NetworkConfig
 
 	Typings bool
 	Mouse   bool
@@ -70,6 +96,18 @@ type Config struct {
 
 	Colors ConfigColors
 
+	PingTimeout  time.Duration // how long to wait for a PONG, or 0 to wait forever.
+	FloodControl irc.FloodControl
+
+	AutoAway        time.Duration // idle time before being marked away, or 0.
+	AutoAwayMessage string
+
+	CTCPReplies irc.CTCPReplies
+
+	MonitorHighlight bool // whether to run the highlight command on presence changes.
+
+	BanMask string // how to make ban masks from nicknames, one of banMaskStyles.
+
 	Debug bool
 }
 
@@ -83,13 +121,16 @@ func DefaultHighlightPath() (string, error) {
 
 func Defaults() (cfg Config, err error) {
 	cfg = Config{
-		Addr:            "",
-		Nick:            "",
-		Real:            "",
-		User:            "",
-		Password:        nil,
-		TLS:             true,
-		Channels:        nil,
+		NetworkConfig: NetworkConfig{
+			Addr:     "",
+			Nick:     "",
+			Real:     "",
+			User:     "",
+			Password: nil,
+			TLS:      true,
+			Channels: nil,
+		},
+		Networks:        nil,
 		Typings:         true,
 		Mouse:           true,
 		Highlights:      nil,
@@ -100,7 +141,13 @@ func Defaults() (cfg Config, err error) {
 		Colors: ConfigColors{
 			Prompt: Color(tcell.ColorDefault),
 		},
-		Debug: false,
+		PingTimeout:     60 * time.Second,
+		FloodControl:    irc.DefaultFloodControl,
+		AutoAway:        0,
+		AutoAwayMessage: defaultAwayMessage,
+		CTCPReplies:     irc.DefaultCTCPReplies(),
+		BanMask:         "host",
+		Debug:           false,
 	}
 
 	return
@@ -116,75 +163,137 @@ func LoadConfigFile(filename string) (cfg Config, err error) {
 	if err != nil {
 		return cfg, err
 	}
-	if cfg.Addr == "" {
+	if cfg.Addr == "" && len(cfg.Networks) == 0 {
 		return cfg, errors.New("addr is required")
 	}
-	if cfg.Nick == "" {
-		return cfg, errors.New("nick is required")
-	}
-	if cfg.User == "" {
-		cfg.User = cfg.Nick
+	if cfg.Addr != "" {
+		if err := cfg.NetworkConfig.check(); err != nil {
+			return cfg, err
+		}
 	}
-	if cfg.Real == "" {
-		cfg.Real = cfg.Nick
+	for i := range cfg.Networks {
+		if err := cfg.Networks[i].check(); err != nil {
+			return cfg, fmt.Errorf("network %q: %v", cfg.Networks[i].Name, err)
+		}
 	}
 	return
 }
 
+// check ensures required settings are present and fills in the optional ones.
+func (n *NetworkConfig) check() error {
+	if n.Addr == "" {
+		return errors.New("addr is required")
+	}
+	if n.Nick == "" {
+		return errors.New("nick is required")
+	}
+	if strings.HasPrefix(n.Addr, "ws://") || strings.HasPrefix(n.Addr, "wss://") {
+		u, err := url.Parse(n.Addr)
+		if err != nil || u.Hostname() == "" {
+			return fmt.Errorf("invalid WebSocket URL %q", n.Addr)
+		}
+		// The scheme tells whether to use TLS.
+		n.TLS = u.Scheme == "wss"
+	}
+	if n.User == "" {
+		n.User = n.Nick
+	}
+	if n.Real == "" {
+		n.Real = n.Nick
+	}
+	if n.TLSKey != "" && n.TLSCert == "" {
+		return errors.New("tls-key requires tls-certificate")
+	}
+	if n.TLSCert != "" {
+		if !n.TLS {
+			return errors.New("tls-certificate requires tls")
+		}
+		if _, err := n.clientCertificate(); err != nil {
+			return fmt.Errorf("failed to load the client certificate: %v", err)
+		}
+	}
+	if (n.TLSCA != "" || n.TLSFingerprint != "" || n.TLSInsecure) && !n.TLS {
+		return errors.New("tls-ca, tls-fingerprint and tls-insecure require tls")
+	}
+	if n.TLSCA != "" {
+		if _, err := n.rootCAs(); err != nil {
+			return fmt.Errorf("failed to load the CA bundle: %v", err)
+		}
+	}
+	if n.Proxy != "" {
+		if _, err := parseProxy(n.Proxy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// websocketURL returns the URL of the server of n, and whether to connect to it
+// over WebSocket.
+func (n *NetworkConfig) websocketURL() (*url.URL, bool) {
+	if !strings.HasPrefix(n.Addr, "ws://") && !strings.HasPrefix(n.Addr, "wss://") {
+		return nil, false
+	}
+	u, err := url.Parse(n.Addr)
+	if err != nil {
+		return nil, false
+	}
+	return u, true
+}
+
+// rootCAs loads the certificates of the CA bundle, or returns nil to use the
+// system's roots.
+func (n *NetworkConfig) rootCAs() (*x509.CertPool, error) {
+	if n.TLSCA == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(n.TLSCA)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %q", n.TLSCA)
+	}
+	return roots, nil
+}
+
+// parseFingerprint normalizes a SHA-256 fingerprint written in hexadecimal,
+// with or without colons, into lowercase hexadecimal.
+func parseFingerprint(s string) (string, error) {
+	fp := strings.ToLower(strings.ReplaceAll(s, ":", ""))
+	if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 fingerprint %q", s)
+	}
+	return fp, nil
+}
+
+// clientCertificate loads the client certificate and its private key.
+func (n *NetworkConfig) clientCertificate() (tls.Certificate, error) {
+	key := n.TLSKey
+	if key == "" {
+		key = n.TLSCert
+	}
+	return tls.LoadX509KeyPair(n.TLSCert, key)
+}
+
 func unmarshal(filename string, cfg *Config) (err error) {
 	directives, err := scfg.Load(filename)
 	if err != nil {
 		return fmt.Errorf("error parsing scfg: %s", err)
 	}
 
+	var networks []*scfg.Directive
 	for _, d := range directives {
-		switch d.Name {
-		case "address":
-			if err := d.ParseParams(&cfg.Addr); err != nil {
-				return err
-			}
-		case "nickname":
-			if err := d.ParseParams(&cfg.Nick); err != nil {
-				return err
-			}
-		case "username":
-			if err := d.ParseParams(&cfg.User); err != nil {
-				return err
-			}
-		case "realname":
-			if err := d.ParseParams(&cfg.Real); err != nil {
-				return err
-			}
-		case "password":
-			// if a password-cmd is provided, don't use this value
-			if directives.Get("password-cmd") != nil {
-				continue
-			}
-
-			var password string
-			if err := d.ParseParams(&password); err != nil {
-				return err
-			}
-			cfg.Password = &password
-		case "password-cmd":
-			var cmdName string
-			if err := d.ParseParams(&cmdName); err != nil {
-				return err
-			}
-
-			cmd := exec.Command(cmdName, d.Params[1:]...)
-			var stdout []byte
-			if stdout, err = cmd.Output(); err != nil {
-				return fmt.Errorf("error running password command: %s", err)
-			}
+		if ok, err := unmarshalNetwork(directives, d, &cfg.NetworkConfig); err != nil {
+			return err
+		} else if ok {
+			continue
+		}
 
-			passCmdOut := strings.Split(string(stdout), "\n")
-			if len(passCmdOut) >= 1 {
-				cfg.Password = &passCmdOut[0]
-			}
-		case "channel":
-			// TODO: does this work with soju.im/bouncer-networks extension?
-			cfg.Channels = append(cfg.Channels, d.Params...)
+		switch d.Name {
+		case "network":
+			networks = append(networks, d)
 		case "highlight":
 			cfg.Highlights = append(cfg.Highlights, d.Params...)
 		case "on-highlight-path":
@@ -225,15 +334,6 @@ func unmarshal(filename string, cfg *Config) (err error) {
 					return fmt.Errorf("unknown directive %q", child.Name)
 				}
 			}
-		case "tls":
-			var tls string
-			if err := d.ParseParams(&tls); err != nil {
-				return err
-			}
-
-			if cfg.TLS, err = strconv.ParseBool(tls); err != nil {
-				return err
-			}
 		case "typings":
 			var typings string
 			if err := d.ParseParams(&typings); err != nil {
@@ -268,6 +368,100 @@ func unmarshal(filename string, cfg *Config) (err error) {
 					return fmt.Errorf("unknown directive %q", child.Name)
 				}
 			}
+		case "flood-control":
+			for _, child := range d.Children {
+				switch child.Name {
+				case "burst":
+					var burst string
+					if err := child.ParseParams(&burst); err != nil {
+						return err
+					}
+
+					if cfg.FloodControl.Burst, err = strconv.Atoi(burst); err != nil || cfg.FloodControl.Burst < 1 {
+						return fmt.Errorf("invalid flood-control burst %q", burst)
+					}
+				case "rate":
+					var rate string
+					if err := child.ParseParams(&rate); err != nil {
+						return err
+					}
+
+					r, err := strconv.ParseFloat(rate, 64)
+					if err != nil || r < 0 {
+						return fmt.Errorf("invalid flood-control rate %q", rate)
+					}
+					if r == 0 {
+						cfg.FloodControl.Period = 0
+					} else {
+						cfg.FloodControl.Period = time.Duration(float64(time.Second) / r)
+					}
+				default:
+					return fmt.Errorf("unknown directive %q", child.Name)
+				}
+			}
+		case "ping-timeout":
+			var timeout string
+			if err := d.ParseParams(&timeout); err != nil {
+				return err
+			}
+
+			seconds, err := strconv.Atoi(timeout)
+			if err != nil || seconds < 0 {
+				return fmt.Errorf("invalid ping-timeout %q", timeout)
+			}
+			cfg.PingTimeout = time.Duration(seconds) * time.Second
+		case "auto-away":
+			var idle string
+			if err := d.ParseParams(&idle); err != nil {
+				return err
+			}
+
+			seconds, err := strconv.Atoi(idle)
+			if err != nil || seconds < 0 {
+				return fmt.Errorf("invalid auto-away %q", idle)
+			}
+			cfg.AutoAway = time.Duration(seconds) * time.Second
+			if len(d.Params) > 1 {
+				cfg.AutoAwayMessage = strings.Join(d.Params[1:], " ")
+			}
+		case "ban-mask":
+			if err := d.ParseParams(&cfg.BanMask); err != nil {
+				return err
+			}
+
+			if _, ok := banMaskStyles[cfg.BanMask]; !ok {
+				return fmt.Errorf("invalid ban-mask %q", cfg.BanMask)
+			}
+		case "monitor-highlight":
+			var highlight string
+			if err := d.ParseParams(&highlight); err != nil {
+				return err
+			}
+
+			if cfg.MonitorHighlight, err = strconv.ParseBool(highlight); err != nil {
+				return err
+			}
+		case "ctcp":
+			for _, child := range d.Children {
+				switch child.Name {
+				case "version", "source":
+					var reply string
+					if err := child.ParseParams(&reply); err != nil {
+						return err
+					}
+
+					cfg.CTCPReplies[strings.ToUpper(child.Name)] = reply
+				case "disable":
+					if len(child.Params) == 0 {
+						return errors.New("ctcp disable requires at least one command")
+					}
+					for _, command := range child.Params {
+						delete(cfg.CTCPReplies, strings.ToUpper(command))
+					}
+				default:
+					return fmt.Errorf("unknown directive %q", child.Name)
+				}
+			}
 		case "debug":
 			var debug string
 			if err := d.ParseParams(&debug); err != nil {
@@ -282,5 +476,145 @@ func unmarshal(filename string, cfg *Config) (err error) {
 		}
 	}
 
+	names := map[string]struct{}{}
+	for _, d := range networks {
+		// Networks inherit the identity of the top-level one, but not
+		// where to connect.
+		n := NetworkConfig{
+			Nick:     cfg.Nick,
+			AltNicks: cfg.AltNicks,
+			Real:     cfg.Real,
+			User:     cfg.User,
+			TLS:      cfg.TLS,
+			Proxy:    cfg.Proxy,
+		}
+		if err := d.ParseParams(&n.Name); err != nil {
+			return err
+		}
+		if n.Name == "" || strings.ContainsAny(n.Name, " /") {
+			return fmt.Errorf("invalid network name %q", n.Name)
+		}
+		if _, ok := names[n.Name]; ok {
+			return fmt.Errorf("duplicate network %q", n.Name)
+		}
+		names[n.Name] = struct{}{}
+
+		for _, child := range d.Children {
+			ok, err := unmarshalNetwork(d.Children, child, &n)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("unknown directive %q in network %q", child.Name, n.Name)
+			}
+		}
+		cfg.Networks = append(cfg.Networks, n)
+	}
+
 	return
 }
+
+// unmarshalNetwork parses d into n if it is a network setting, and reports
+// whether it did so.  block is the block d belongs to.
+func unmarshalNetwork(block scfg.Block, d *scfg.Directive, n *NetworkConfig) (ok bool, err error) {
+	switch d.Name {
+	case "address":
+		if err := d.ParseParams(&n.Addr); err != nil {
+			return true, err
+		}
+	case "nickname":
+		if err := d.ParseParams(&n.Nick); err != nil {
+			return true, err
+		}
+	case "alt-nicknames":
+		if len(d.Params) == 0 {
+			return true, errors.New("alt-nicknames requires at least one nickname")
+		}
+		n.AltNicks = d.Params
+	case "username":
+		if err := d.ParseParams(&n.User); err != nil {
+			return true, err
+		}
+	case "realname":
+		if err := d.ParseParams(&n.Real); err != nil {
+			return true, err
+		}
+	case "password":
+		// if a password-cmd is provided, don't use this value
+		if block.Get("password-cmd") != nil {
+			break
+		}
+
+		var password string
+		if err := d.ParseParams(&password); err != nil {
+			return true, err
+		}
+		n.Password = &password
+	case "password-cmd":
+		var cmdName string
+		if err := d.ParseParams(&cmdName); err != nil {
+			return true, err
+		}
+
+		cmd := exec.Command(cmdName, d.Params[1:]...)
+		var stdout []byte
+		if stdout, err = cmd.Output(); err != nil {
+			return true, fmt.Errorf("error running password command: %s", err)
+		}
+
+		passCmdOut := strings.Split(string(stdout), "\n")
+		if len(passCmdOut) >= 1 {
+			n.Password = &passCmdOut[0]
+		}
+	case "channel":
+		n.Channels = append(n.Channels, d.Params...)
+	case "monitor":
+		n.Monitor = append(n.Monitor, d.Params...)
+	case "tls":
+		var tls string
+		if err := d.ParseParams(&tls); err != nil {
+			return true, err
+		}
+
+		if n.TLS, err = strconv.ParseBool(tls); err != nil {
+			return true, err
+		}
+	case "tls-certificate":
+		if err := d.ParseParams(&n.TLSCert); err != nil {
+			return true, err
+		}
+	case "tls-key":
+		if err := d.ParseParams(&n.TLSKey); err != nil {
+			return true, err
+		}
+	case "tls-ca":
+		if err := d.ParseParams(&n.TLSCA); err != nil {
+			return true, err
+		}
+	case "tls-fingerprint":
+		var fingerprint string
+		if err := d.ParseParams(&fingerprint); err != nil {
+			return true, err
+		}
+
+		if n.TLSFingerprint, err = parseFingerprint(fingerprint); err != nil {
+			return true, err
+		}
+	case "proxy":
+		if err := d.ParseParams(&n.Proxy); err != nil {
+			return true, err
+		}
+	case "tls-insecure":
+		var insecure string
+		if err := d.ParseParams(&insecure); err != nil {
+			return true, err
+		}
+
+		if n.TLSInsecure, err = strconv.ParseBool(insecure); err != nil {
+			return true, err
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
@@ -2,39 +2,214 @@ package irc
 
 import (
 	"bufio"
-	"fmt"
 	"net"
+	"strings"
+	"time"
 )
 
 const chanCapacity = 64
 
-func ChanInOut(conn net.Conn) (in <-chan Message, out chan<- Message) {
+// FloodControl defines how fast messages are sent to the server, so that it
+// does not disconnect us for flooding.
+//
+// Like servers do, each message costs Period, plus a share of Period
+// proportional to its length: a whole Period for 512 bytes.  Up to Burst
+// messages can be sent at once; after that, messages are queued and sent as
+// the cost of the previous ones expires.  PING and PONG messages are always
+// sent right away, so that the lag is measured regardless of the queue.  QUIT
+// messages are sent right after the messages queued before them, and the
+// queue is sent before the connection is closed.
+//
+// Messages are only paced once the server has welcomed us, so that
+// registration is not held back.
+type FloodControl struct {
+	Burst  int
+	Period time.Duration // 0 disables flood control.
+}
+
+// DefaultFloodControl mirrors the penalties of common server implementations.
+var DefaultFloodControl = FloodControl{
+	Burst:  5,
+	Period: 2 * time.Second,
+}
+
+// clock is the source of time of the flood control, replaced in tests.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// floodBucket is a token bucket, expressed as the time until which the server
+// considers we have been sending messages.
+type floodBucket struct {
+	fc   FloodControl
+	next time.Time
+}
+
+// cost returns how long the server considers line to take to send.
+func (b *floodBucket) cost(line string) time.Duration {
+	return b.fc.Period + b.fc.Period*time.Duration(len(line))/512
+}
+
+// take reports whether line can be sent at the given time, and charges its
+// cost if so, or if force is true.  Otherwise, it returns how long to wait
+// before line can be sent.
+func (b *floodBucket) take(line string, now time.Time, force bool) (ok bool, wait time.Duration) {
+	if b.fc.Period == 0 {
+		return true, 0
+	}
+	if b.next.Before(now) {
+		b.next = now
+	}
+	capacity := time.Duration(b.fc.Burst) * b.fc.Period
+	if ahead := b.next.Sub(now); capacity < ahead && !force {
+		return false, ahead - capacity
+	}
+	b.next = b.next.Add(b.cost(line))
+	return true, 0
+}
+
+// isUrgent reports whether msg must bypass the flood control queue.
+func isUrgent(msg Message) bool {
+	return msg.Command == "PING" || msg.Command == "PONG"
+}
+
+// sendLoop reads messages from out and passes them to write, paced by fc once
+// welcome is closed, that is once the server has welcomed us.  Messages that
+// are ready at the same time are passed together.  It returns when write
+// fails, or once out is closed and the queue has been sent.
+func sendLoop(out <-chan Message, fc FloodControl, clk clock, welcome <-chan struct{}, write func(lines []string) error) {
+	bucket := floodBucket{fc: fc}
+	paced := false
+	closed := false
+	var queue []Message
+	var wait <-chan time.Time
+	for {
+		var urgent []string
+		add := func(msg Message) {
+			if isUrgent(msg) {
+				urgent = append(urgent, msg.String())
+			} else {
+				queue = append(queue, msg)
+			}
+		}
+
+		in := out
+		if closed {
+			in = nil
+		}
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				closed = true
+			} else {
+				add(msg)
+			}
+		case <-wait:
+		case <-welcome:
+		}
+	Batch:
+		for !closed {
+			select {
+			case msg, ok := <-out:
+				if !ok {
+					closed = true
+					break Batch
+				}
+				add(msg)
+			default:
+				break Batch
+			}
+		}
+
+		if !paced {
+			select {
+			case <-welcome:
+				welcome = nil
+				paced = true
+			default:
+			}
+		}
+
+		now := clk.Now()
+		lines := urgent
+		for _, line := range urgent {
+			bucket.take(line, now, true)
+		}
+		wait = nil
+		for len(queue) != 0 {
+			line := queue[0].String()
+			if paced {
+				// QUIT waits for the messages before it, but not for
+				// the server to accept more.
+				ok, d := bucket.take(line, now, queue[0].Command == "QUIT")
+				if !ok {
+					wait = clk.After(d)
+					break
+				}
+			}
+			lines = append(lines, line)
+			queue = queue[1:]
+		}
+		if len(lines) != 0 {
+			if err := write(lines); err != nil {
+				return
+			}
+		}
+		if closed && len(queue) == 0 {
+			return
+		}
+	}
+}
+
+// notifyWelcome closes welcome if msg is the welcome of the server, and
+// returns the channel to pass for the next messages.
+func notifyWelcome(msg Message, welcome chan struct{}) chan struct{} {
+	if welcome != nil && msg.Command == rplWelcome {
+		close(welcome)
+		return nil
+	}
+	return welcome
+}
+
+// ChanInOut returns channels to read messages from and write messages to the
+// given connection.  Messages are written according to fc.  sent is closed
+// once out is closed and the messages written to it have been sent, or the
+// connection failed.
+func ChanInOut(conn net.Conn, fc FloodControl) (in <-chan Message, out chan<- Message, sent <-chan struct{}) {
 	in_ := make(chan Message, chanCapacity)
 	out_ := make(chan Message, chanCapacity)
+	sent_ := make(chan struct{})
+	welcome := make(chan struct{})
 
 	go func() {
 		r := bufio.NewScanner(conn)
+		w := welcome
 		for r.Scan() {
 			line := r.Text()
 			msg, err := ParseMessage(line)
 			if err != nil {
 				continue
 			}
+			w = notifyWelcome(msg, w)
 			in_ <- msg
 		}
 		close(in_)
 	}()
 
 	go func() {
-		for msg := range out_ {
-			// TODO send messages by batches
-			_, err := fmt.Fprintf(conn, "%s\r\n", msg.String())
-			if err != nil {
-				break
-			}
-		}
+		sendLoop(out_, fc, realClock{}, welcome, func(lines []string) error {
+			_, err := conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+			return err
+		})
 		_ = conn.Close()
+		close(sent_)
 	}()
 
-	return in_, out_
+	return in_, out_, sent_
 }
@@ -0,0 +1,235 @@
+package irc
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves forward when told to.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	waiting chan time.Duration // receives the duration of each After call.
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC),
+		waiting: make(chan time.Duration, 16),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	c.waiting <- d
+	return t.c
+}
+
+// Advance moves the clock forward and fires the timers that expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			timers = append(timers, t)
+		} else {
+			t.c <- c.now
+		}
+	}
+	c.timers = timers
+}
+
+// welcomed returns a closed channel, to pace messages from the start.
+func welcomed() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+// startSendLoop runs sendLoop and returns the channel it reads from and the
+// channel where each write is sent.
+func startSendLoop(t *testing.T, fc FloodControl, clk clock) (out chan Message, writes chan []string) {
+	out = make(chan Message, chanCapacity)
+	writes = make(chan []string, chanCapacity)
+	go func() {
+		sendLoop(out, fc, clk, welcomed(), func(lines []string) error {
+			writes <- lines
+			return nil
+		})
+		close(writes)
+	}()
+	t.Cleanup(func() { close(out) })
+	return out, writes
+}
+
+func expectWrite(t *testing.T, writes chan []string, expected ...string) {
+	t.Helper()
+	select {
+	case lines := <-writes:
+		if !reflect.DeepEqual(lines, expected) {
+			t.Errorf("expected %q to be written, got %q", expected, lines)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected %q to be written, got nothing", expected)
+	}
+}
+
+func expectNoWrite(t *testing.T, writes chan []string) {
+	t.Helper()
+	select {
+	case lines := <-writes:
+		t.Errorf("expected nothing to be written, got %q", lines)
+	default:
+	}
+}
+
+func TestFloodControl(t *testing.T) {
+	clk := newFakeClock()
+	fc := FloodControl{Burst: 3, Period: time.Second}
+	bucket := floodBucket{fc: fc}
+	line := NewMessage("PRIVMSG", "#senpai", "hi")
+	cost := bucket.cost(line.String())
+	if expected := time.Second + time.Second*18/512; cost != expected {
+		t.Fatalf("expected a cost of %s, got %s", expected, cost)
+	}
+
+	out := make(chan Message, chanCapacity)
+	for i := 0; i < 5; i++ {
+		out <- line
+	}
+	writes := make(chan []string, chanCapacity)
+	go sendLoop(out, fc, clk, welcomed(), func(lines []string) error {
+		writes <- lines
+		return nil
+	})
+	defer close(out)
+
+	// The burst is sent at once, the rest is queued.
+	expectWrite(t, writes, line.String(), line.String(), line.String())
+	if d := <-clk.waiting; d != 3*cost-3*time.Second {
+		t.Errorf("expected to wait %s, waited %s", 3*cost-3*time.Second, d)
+	}
+
+	// Urgent messages bypass the queue.
+	out <- NewMessage("PONG", "token")
+	expectWrite(t, writes, "PONG token")
+	d := <-clk.waiting
+	if expected := 3*cost + bucket.cost("PONG token") - 3*time.Second; d != expected {
+		t.Errorf("expected to wait %s, waited %s", expected, d)
+	}
+
+	clk.Advance(d - time.Millisecond)
+	expectNoWrite(t, writes)
+	clk.Advance(time.Millisecond)
+	expectWrite(t, writes, line.String())
+
+	d = <-clk.waiting
+	if d != cost {
+		t.Errorf("expected to wait %s, waited %s", cost, d)
+	}
+	clk.Advance(d)
+	expectWrite(t, writes, line.String())
+
+	// Once the bucket has refilled, a full burst can be sent again.
+	clk.Advance(time.Minute)
+	for i := 0; i < 4; i++ {
+		out <- line
+	}
+	expectWrite(t, writes, line.String(), line.String(), line.String())
+	<-clk.waiting
+}
+
+func TestFloodControlRegistration(t *testing.T) {
+	clk := newFakeClock()
+	out := make(chan Message, chanCapacity)
+	writes := make(chan []string, chanCapacity)
+	welcome := make(chan struct{})
+	go sendLoop(out, FloodControl{Burst: 2, Period: time.Second}, clk, welcome, func(lines []string) error {
+		writes <- lines
+		return nil
+	})
+	defer close(out)
+
+	// Registration is not paced, nor charged.
+	for i := 0; i < 4; i++ {
+		out <- NewMessage("CAP", "REQ", "x")
+		expectWrite(t, writes, "CAP REQ x")
+	}
+
+	close(welcome)
+	for i := 0; i < 3; i++ {
+		out <- NewMessage("JOIN", "#senpai")
+	}
+	expectWrite(t, writes, "JOIN #senpai", "JOIN #senpai")
+	<-clk.waiting
+}
+
+func TestUrgentMessages(t *testing.T) {
+	for _, command := range []string{"PING", "PONG"} {
+		if !isUrgent(NewMessage(command, "x")) {
+			t.Errorf("expected %s to bypass the queue", command)
+		}
+	}
+	for _, command := range []string{"PRIVMSG", "JOIN", "MODE", "WHO", "QUIT"} {
+		if isUrgent(NewMessage(command, "x")) {
+			t.Errorf("expected %s to be queued", command)
+		}
+	}
+}
+
+func TestFloodControlDisabled(t *testing.T) {
+	out, writes := startSendLoop(t, FloodControl{}, newFakeClock())
+	for i := 0; i < 10; i++ {
+		out <- NewMessage("PRIVMSG", "#senpai", "hi")
+		expectWrite(t, writes, "PRIVMSG #senpai hi")
+	}
+}
+
+func TestFloodControlQuit(t *testing.T) {
+	clk := newFakeClock()
+	out := make(chan Message, chanCapacity)
+	writes := make(chan []string, chanCapacity)
+	for i := 0; i < 3; i++ {
+		out <- NewMessage("PRIVMSG", "#senpai", "hi")
+	}
+	out <- NewMessage("QUIT", "bye")
+	close(out)
+	done := make(chan struct{})
+	go func() {
+		sendLoop(out, FloodControl{Burst: 2, Period: time.Second}, clk, welcomed(), func(lines []string) error {
+			writes <- lines
+			return nil
+		})
+		close(done)
+	}()
+
+	// The queue is sent before the loop stops, and QUIT goes right after
+	// the messages queued before it.
+	expectWrite(t, writes, "PRIVMSG #senpai hi", "PRIVMSG #senpai hi")
+	clk.Advance(<-clk.waiting)
+	expectWrite(t, writes, "PRIVMSG #senpai hi", "QUIT bye")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the loop to stop once the channel is closed")
+	}
+}
@@ -0,0 +1,71 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// CTCPReplies are the replies given to CTCP requests, by upper-case command.
+// The replies to CLIENTINFO, PING and TIME are computed, so their value is
+// ignored.  Requests for other commands are not answered.
+type CTCPReplies map[string]string
+
+// DefaultCTCPReplies returns the replies senpai gives by default.
+func DefaultCTCPReplies() CTCPReplies {
+	return CTCPReplies{
+		"CLIENTINFO": "",
+		"PING":       "",
+		"SOURCE":     "https://git.sr.ht/~taiite/senpai",
+		"TIME":       "",
+		"VERSION":    "senpai",
+	}
+}
+
+// reply returns the reply to the given request, and whether it should be
+// answered.
+func (r CTCPReplies) reply(command, params string) (reply string, ok bool) {
+	reply, ok = r[command]
+	if !ok {
+		return "", false
+	}
+	switch command {
+	case "CLIENTINFO":
+		commands := []string{"ACTION"}
+		for c := range r {
+			commands = append(commands, c)
+		}
+		sort.Strings(commands)
+		reply = strings.Join(commands, " ")
+	case "PING":
+		reply = params
+	case "TIME":
+		reply = time.Now().Format(time.RFC1123Z)
+	}
+	return reply, true
+}
+
+// ParseCTCP parses the CTCP message contained in the content of a PRIVMSG or
+// NOTICE.  ok is false if content is not a CTCP message.
+func ParseCTCP(content string) (command, params string, ok bool) {
+	if len(content) < 2 || content[0] != '\x01' {
+		return "", "", false
+	}
+	content = strings.TrimSuffix(content[1:], "\x01")
+	if i := strings.IndexByte(content, ' '); i >= 0 {
+		command, params = content[:i], content[i+1:]
+	} else {
+		command = content
+	}
+	command = strings.ToUpper(command)
+	return command, params, command != ""
+}
+
+// CTCP returns the content of a PRIVMSG or NOTICE that carries the given CTCP
+// message.
+func CTCP(command, params string) string {
+	if params == "" {
+		return "\x01" + command + "\x01"
+	}
+	return "\x01" + command + " " + params + "\x01"
+}
@@ -2,6 +2,8 @@ package irc
 
 import "time"
 
+// Event is what HandleMessage makes of a message.  The ID field of events,
+// when they have one, is the msgid tag of the message, or "" if absent.
 type Event interface{}
 
 type ErrorEvent struct {
@@ -20,6 +22,25 @@ type UserNickEvent struct {
 	User       string
 	FormerNick string
 	Time       time.Time
+	ID         string
+}
+
+// UserHostEvent is sent when the username or hostname of a user changes.
+type UserHostEvent struct {
+	User       string
+	FormerHost string // as "user@host".
+	Host       string // as "user@host".
+	Time       time.Time
+	ID         string
+}
+
+// UserRealNameEvent is sent when a user changes their realname.
+type UserRealNameEvent struct {
+	User           string
+	FormerRealName string // "" if unknown.
+	RealName       string
+	Time           time.Time
+	ID             string
 }
 
 type SelfJoinEvent struct {
@@ -32,6 +53,7 @@ type UserJoinEvent struct {
 	User    string
 	Channel string
 	Time    time.Time
+	ID      string
 }
 
 type SelfPartEvent struct {
@@ -41,25 +63,70 @@ type SelfPartEvent struct {
 type UserPartEvent struct {
 	User    string
 	Channel string
+	Reason  string // "" if not given.
 	Time    time.Time
+	ID      string
+}
+
+// UserKickEvent is sent when a user is kicked from a channel.
+type UserKickEvent struct {
+	User    string // the user who has been kicked.
+	Kicker  string
+	Channel string
+	Comment string // "" if not given.
+	Time    time.Time
+	ID      string
+}
+
+// SelfKickEvent is sent when we are kicked from a channel.
+type SelfKickEvent struct {
+	Kicker  string
+	Channel string
+	Comment string // "" if not given.
+	Time    time.Time
+}
+
+// SelfAwayEvent is sent when the server confirms that we are, or are no
+// longer, marked as being away.
+type SelfAwayEvent struct {
+	Away bool
+}
+
+// UserAwayEvent is sent when the server tells that a user we are messaging is
+// away, once per away message.
+type UserAwayEvent struct {
+	User    string
+	Message string
 }
 
 type UserQuitEvent struct {
 	User     string
 	Channels []string
+	Reason   string // "" if not given.
 	Time     time.Time
+	ID       string
 }
 
 type TopicChangeEvent struct {
 	Channel string
 	Topic   string
 	Time    time.Time
+	ID      string
 }
 
 type ModeChangeEvent struct {
 	Channel string
-	Mode    string
+	User    string       // who changed the modes, "" if unknown.
+	Mode    string       // the modes and their parameters, as given by the server.
+	Changes []ModeChange // the parsed modes, nil if they cannot be parsed.
 	Time    time.Time
+	ID      string
+}
+
+// ChannelModesEvent is sent when the server tells the modes of a channel,
+// usually after we join it.
+type ChannelModesEvent struct {
+	Channel string
 }
 
 type InviteEvent struct {
@@ -70,11 +137,109 @@ type InviteEvent struct {
 
 type MessageEvent struct {
 	User            string
+	Account         string // the account User is logged in to, or "" if unknown.
+	Unidentified    bool   // whether User was seen logged in to another account.
 	Target          string
 	TargetIsChannel bool
 	Command         string
 	Content         string
 	Time            time.Time
+	ID              string
+	ReplyTo         string // the msgid of the message this one replies to, or "".
+}
+
+// ReactionEvent is sent when a user reacts to a message (with a TAGMSG
+// carrying +draft/react).
+type ReactionEvent struct {
+	User            string
+	Target          string
+	TargetIsChannel bool
+	ReplyTo         string // the msgid of the message reacted to.
+	Reaction        string
+	Time            time.Time
+	ID              string
+}
+
+// RedactEvent is sent when a user deletes a message.
+type RedactEvent struct {
+	User            string
+	Target          string
+	TargetIsChannel bool
+	Redacted        string // the msgid of the deleted message.
+	Reason          string // "" if not given.
+	Time            time.Time
+}
+
+// CTCPEvent is sent when a user sends a CTCP request other than ACTION.
+type CTCPEvent struct {
+	User    string
+	Target  string
+	Command string
+	Params  string
+	Replied bool // whether the request has been answered automatically.
+	Time    time.Time
+}
+
+// CTCPReplyEvent is sent when a user answers a CTCP request.
+type CTCPReplyEvent struct {
+	User    string
+	Command string
+	Params  string
+	Time    time.Time
+}
+
+// MonitorEvent is sent when users we monitor come online or go offline.
+type MonitorEvent struct {
+	Users  []string
+	Online bool
+}
+
+// WhoisEvent is the reply to a WHOIS, sent once the server has given all the
+// information it has.
+type WhoisEvent struct {
+	Nick       string
+	User       string
+	Host       string
+	RealName   string
+	Server     string
+	ServerInfo string
+	Account    string        // "" if not logged in.
+	Channels   []string      // with their membership prefixes.
+	Idle       time.Duration // 0 if unknown.
+	Signon     time.Time     // zero if unknown.
+	Away       string        // the away message, or "" if not away.
+	Secure     bool          // whether the user is connected with TLS.
+	Operator   bool
+	Info       []string // other replies of the server, as is.
+}
+
+// ListedChannel is a channel given in reply to LIST.
+type ListedChannel struct {
+	Name  string
+	Users int
+	Topic string
+}
+
+// ChannelListEvent carries the channels given in reply to LIST.  Channels are
+// sent in several events as they come, the last one having Done set.
+type ChannelListEvent struct {
+	Channels []ListedChannel
+	Done     bool
+}
+
+// ListEntry is an entry of a ban, exception or invite exception list.
+type ListEntry struct {
+	Mask  string
+	SetBy string    // "" if unknown.
+	SetAt time.Time // zero if unknown.
+}
+
+// ModeListEvent is the reply to a request for the ban (mode b), exception
+// (mode e) or invite exception (mode I) list of a channel.
+type ModeListEvent struct {
+	Channel string
+	Mode    byte
+	Entries []ListEntry
 }
 
 type HistoryEvent struct {
@@ -86,6 +251,12 @@ type HistoryTargetsEvent struct {
 	Targets map[string]time.Time
 }
 
+// STSEvent is sent when the server advertises a Strict Transport Security
+// policy.
+type STSEvent struct {
+	Policy STSPolicy
+}
+
 type BouncerNetworkEvent struct {
 	ID   string
 	Name string
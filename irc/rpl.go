@@ -29,9 +29,12 @@ const (
 	rplWhoisidle       = "317" // <nick> <integer> [<integer>] :seconds idle [, signon time]
 	rplEndofwhois      = "318" // <nick> :End of WHOIS list
 	rplWhoischannels   = "319" // <nick> :*( (@/+) <channel> " " )
+	rplListstart       = "321" // Channel :Users  Name
 	rplList            = "322" // <channel> <# of visible members> <topic>
 	rplListend         = "323" // :End of list
 	rplChannelmodeis   = "324" // <channel> <modes> <mode params>
+	rplCreationtime    = "329" // <channel> <creationtime>
+	rplWhoisaccount    = "330" // <nick> <account> :is logged in as
 	rplNotopic         = "331" // <channel> :No topic set
 	rplTopic           = "332" // <channel> <topic>
 	rplTopicwhotime    = "333" // <channel> <nick> <setat>
@@ -43,6 +46,7 @@ const (
 	rplVersion         = "351" // <version> <servername> :<comments>
 	rplWhoreply        = "352" // <channel> <user> <host> <server> <nick> "H"/"G" ["*"] [("@"/"+")] :<hop count> <nick>
 	rplNamreply        = "353" // <=/*/@> <channel> :1*(@/ /+user)
+	rplWhospcrpl       = "354" // <token> <channel> <user> <host> <nick> <flags> <account> :<realname> (for %tcuhnfar)
 	rplEndofnames      = "366" // <channel> :End of names list
 	rplBanlist         = "367" // <channel> <ban mask>
 	rplEndofbanlist    = "368" // <channel> :End of ban list
@@ -67,6 +71,7 @@ const (
 	errNonicknamegiven  = "431" // :No nickname given
 	errErroneusnickname = "432" // <nick> :Erroneous nickname
 	errNicknameinuse    = "433" // <nick> :Nickname in use
+	errNickcollision    = "436" // <nick> :Nickname collision KILL
 	errUsernotinchannel = "441" // <nick> <channel> :User not in channel
 	errNotonchannel     = "442" // <channel> :You're not on that channel
 	errUseronchannel    = "443" // <user> <channel> :is already on channel
@@ -87,6 +92,14 @@ const (
 	errUmodeunknownflag = "501" // :Unknown mode flag
 	errUsersdontmatch   = "502" // :Can't change mode for other users
 
+	rplWhoissecure = "671" // <nick> :is using a secure connection
+
+	rplMononline    = "730" // <nick> :target[!user@host][,target[!user@host]]*
+	rplMonoffline   = "731" // <nick> :target[,target2]*
+	rplMonlist      = "732" // <nick> :target[,target2]*
+	rplEndofmonlist = "733" // <nick> :End of MONITOR list
+	errMonlistfull  = "734" // <nick> <limit> <targets> :Monitor list is full
+
 	rplLoggedin    = "900" // <nick> <nick>!<ident>@<host> <account> :You are now logged in as <user>
 	rplLoggedout   = "901" // <nick> <nick>!<ident>@<host> :You are now logged out
 	errNicklocked  = "902" // :You must use a nick assigned to you
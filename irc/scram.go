@@ -0,0 +1,174 @@
+package irc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SASLScram implements the SCRAM-SHA-256 mechanism, which proves the
+// knowledge of the password without sending it, and authenticates the server
+// in return.
+//
+// ref: https://datatracker.ietf.org/doc/html/rfc5802
+// ref: https://datatracker.ietf.org/doc/html/rfc7677
+type SASLScram struct {
+	Username string
+	Password string
+
+	step            int    // number of challenges answered so far.
+	nonce           string // client nonce.
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func (auth *SASLScram) Handshake() (mech string) {
+	var nonce [18]byte
+	_, _ = rand.Read(nonce[:])
+	auth.step = 0
+	auth.nonce = base64.RawStdEncoding.EncodeToString(nonce[:])
+	auth.clientFirstBare = ""
+	auth.serverSignature = nil
+
+	mech = "SCRAM-SHA-256"
+	return
+}
+
+func (auth *SASLScram) Respond(challenge string) (res string, err error) {
+	step := auth.step
+	auth.step++
+
+	switch step {
+	case 0:
+		if challenge != "+" {
+			err = errors.New("unexpected challenge")
+			return
+		}
+		auth.clientFirstBare = "n=" + scramEscape(auth.Username) + ",r=" + auth.nonce
+		res = base64.StdEncoding.EncodeToString([]byte("n,," + auth.clientFirstBare))
+	case 1:
+		var serverFirst []byte
+		serverFirst, err = base64.StdEncoding.DecodeString(challenge)
+		if err != nil {
+			return
+		}
+		var clientFinal string
+		clientFinal, err = auth.clientFinal(string(serverFirst))
+		if err != nil {
+			return
+		}
+		res = base64.StdEncoding.EncodeToString([]byte(clientFinal))
+	case 2:
+		var serverFinal []byte
+		serverFinal, err = base64.StdEncoding.DecodeString(challenge)
+		if err != nil {
+			return
+		}
+		attrs := scramAttributes(string(serverFinal))
+		if e, ok := attrs['e']; ok {
+			err = fmt.Errorf("server error: %s", e)
+			return
+		}
+		var signature []byte
+		signature, err = base64.StdEncoding.DecodeString(attrs['v'])
+		if err != nil {
+			return
+		}
+		if subtle.ConstantTimeCompare(signature, auth.serverSignature) != 1 {
+			err = errors.New("invalid server signature")
+			return
+		}
+		res = "+"
+	default:
+		err = errors.New("unexpected challenge")
+	}
+
+	return
+}
+
+// clientFinal computes the client-final-message from the server-first-message,
+// along with the signature expected from the server.
+func (auth *SASLScram) clientFinal(serverFirst string) (string, error) {
+	attrs := scramAttributes(serverFirst)
+	if _, ok := attrs['m']; ok {
+		return "", errors.New("unsupported mandatory extension")
+	}
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, auth.nonce) || len(nonce) == len(auth.nonce) {
+		return "", errors.New("invalid server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil || len(salt) == 0 {
+		return "", errors.New("invalid salt")
+	}
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations <= 0 {
+		return "", errors.New("invalid iteration count")
+	}
+
+	saltedPassword := scramHi([]byte(auth.Password), salt, iterations)
+	clientKey := scramHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := scramHMAC(saltedPassword, []byte("Server Key"))
+
+	// "biws" is the base64 encoding of "n,,", the GS2 header.
+	clientFinalWithoutProof := "c=biws,r=" + nonce
+	authMessage := []byte(auth.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof)
+
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	auth.serverSignature = scramHMAC(serverKey, authMessage)
+
+	return clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// scramEscape escapes a username for use in a "n=" attribute.
+func scramEscape(name string) string {
+	name = strings.ReplaceAll(name, "=", "=3D")
+	name = strings.ReplaceAll(name, ",", "=2C")
+	return name
+}
+
+// scramAttributes parses the "a=value" comma-separated pairs of a SCRAM
+// message.
+func scramAttributes(msg string) map[byte]string {
+	attrs := map[byte]string{}
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		attrs[attr[0]] = attr[2:]
+	}
+	return attrs
+}
+
+func scramHMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// scramHi is PBKDF2 with HMAC-SHA-256, with an output the size of one hash.
+func scramHi(password, salt []byte, iterations int) []byte {
+	var one [4]byte
+	binary.BigEndian.PutUint32(one[:], 1)
+	u := scramHMAC(password, append(append([]byte{}, salt...), one[:]...))
+	res := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = scramHMAC(password, u)
+		for j := range res {
+			res[j] ^= u[j]
+		}
+	}
+	return res
+}
@@ -0,0 +1,70 @@
+package irc
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// Test vector from RFC 7677, section 3.
+func TestSASLScram(t *testing.T) {
+	auth := &SASLScram{Username: "user", Password: "pencil"}
+	if mech := auth.Handshake(); mech != "SCRAM-SHA-256" {
+		t.Fatalf("expected mechanism SCRAM-SHA-256, got %q", mech)
+	}
+	auth.nonce = "rOprNGfwEbeRWgbNEkqO"
+
+	steps := []struct {
+		challenge string
+		response  string
+	}{
+		{
+			challenge: "+",
+			response:  b64("n,,n=user,r=rOprNGfwEbeRWgbNEkqO"),
+		},
+		{
+			challenge: b64("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"),
+			response:  b64("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="),
+		},
+		{
+			challenge: b64("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="),
+			response:  "+",
+		},
+	}
+	for i, step := range steps {
+		res, err := auth.Respond(step.challenge)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if res != step.response {
+			t.Fatalf("step %d: expected %q, got %q", i, step.response, res)
+		}
+	}
+}
+
+func TestSASLScramBadServer(t *testing.T) {
+	auth := &SASLScram{Username: "user", Password: "pencil"}
+	auth.Handshake()
+	auth.nonce = "rOprNGfwEbeRWgbNEkqO"
+	if _, err := auth.Respond("+"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Respond(b64("r=someoneelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")); err == nil {
+		t.Error("expected a server nonce not extending ours to be rejected")
+	}
+
+	auth.Handshake()
+	auth.nonce = "rOprNGfwEbeRWgbNEkqO"
+	if _, err := auth.Respond("+"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Respond(b64("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Respond(b64("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err == nil {
+		t.Error("expected a wrong server signature to be rejected")
+	}
+}
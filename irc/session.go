@@ -44,21 +44,48 @@ func (auth *SASLPlain) Respond(challenge string) (res string, err error) {
 	return
 }
 
+// SASLExternal authenticates with credentials established outside of IRC,
+// such as a TLS client certificate.
+type SASLExternal struct{}
+
+func (auth *SASLExternal) Handshake() (mech string) {
+	mech = "EXTERNAL"
+	return
+}
+
+func (auth *SASLExternal) Respond(challenge string) (res string, err error) {
+	if challenge != "+" {
+		err = errors.New("unexpected challenge")
+		return
+	}
+
+	// Empty authorization identity: let the server derive it from the
+	// credentials.
+	res = "+"
+
+	return
+}
+
 // SupportedCapabilities is the set of capabilities supported by this library.
 var SupportedCapabilities = map[string]struct{}{
-	"away-notify":   {},
-	"batch":         {},
-	"cap-notify":    {},
-	"echo-message":  {},
-	"invite-notify": {},
-	"message-tags":  {},
-	"multi-prefix":  {},
-	"server-time":   {},
-	"sasl":          {},
-	"setname":       {},
+	"account-notify": {},
+	"account-tag":    {},
+	"away-notify":    {},
+	"batch":          {},
+	"cap-notify":     {},
+	"chghost":        {},
+	"echo-message":   {},
+	"extended-join":  {},
+	"invite-notify":  {},
+	"message-tags":   {},
+	"multi-prefix":   {},
+	"server-time":    {},
+	"sasl":           {},
+	"setname":        {},
 
 	"draft/chathistory":        {},
 	"draft/event-playback":     {},
+	"draft/message-redaction":  {},
 	"soju.im/bouncer-networks": {},
 }
 
@@ -73,8 +100,10 @@ const (
 
 // User is a known IRC user (we share a channel with it).
 type User struct {
-	Name *Prefix // the nick, user and hostname of the user if known.
-	Away bool    // whether the user is away or not
+	Name     *Prefix // the nick, user and hostname of the user if known.
+	Away     bool    // whether the user is away or not
+	Account  string  // the account the user is logged in to, "" if not or unknown.
+	RealName string  // the realname of the user if known.
 }
 
 // Channel is a joined channel.
@@ -84,17 +113,42 @@ type Channel struct {
 	Topic     string           // the topic of the channel, or "" if absent.
 	TopicWho  *Prefix          // the name of the last user who set the topic.
 	TopicTime time.Time        // the last time the topic has been changed.
+	Modes     map[byte]string  // the modes set (except lists), with their parameter if any.
+	Key       string           // the channel key, or "" if absent.
+	Limit     int              // the member limit, or 0 if absent.
+	Created   time.Time        // when the channel has been created, if known.
 
 	complete bool // whether this structure is fully initialized.
 }
 
+// whoxToken identifies the replies to the WHOX queries sent on join.
+const whoxToken = "771"
+
+// listBatchSize is the number of LIST replies sent in one ChannelListEvent.
+const listBatchSize = 500
+
+// MonitorEntry is a user we monitor, to know when they are online.
+type MonitorEntry struct {
+	Nick   string
+	Online bool
+	Known  bool // whether the server has told whether the user is online.
+}
+
 // SessionParams defines how to connect to an IRC server.
 type SessionParams struct {
-	Nickname string
-	Username string
-	RealName string
-	NetID    string
-	Auth     SASLClient
+	Nickname     string
+	AltNicknames []string // nicknames to try when Nickname is taken.
+	Username     string
+	RealName     string
+	NetID        string
+	Auths        []SASLClient // SASL mechanisms to try, the strongest first.
+	CTCPReplies  CTCPReplies  // replies to CTCP requests, nil to answer none.
+
+	// TLS tells whether the connection is encrypted.  If not and the server
+	// requires TLS with STS, registration stops before requesting anything,
+	// unless NoSTS is set, such as for WebSocket connections.
+	TLS   bool
+	NoSTS bool
 }
 
 type Session struct {
@@ -110,8 +164,27 @@ type Session struct {
 	real   string
 	acct   string
 	host   string
+	tls    bool
+	noSTS  bool
 	netID  string
-	auth   SASLClient
+
+	away bool // whether we are marked as being away.
+
+	ctcpReplies CTCPReplies
+	ctcpLimit   *rate.Limiter // limits the rate of CTCP replies.
+
+	altNicks   []string // alternative nicknames left to try during registration.
+	nickWanted string   // the configured nickname, to regain once registered, or "".
+	regaining  bool     // whether a NICK has been sent to regain nickWanted.
+
+	auths      []SASLClient // SASL mechanisms we can use, the strongest first.
+	stsUpgrade bool         // whether the server requires TLS, which this connection lacks.
+	capReq     bool         // whether the CAP REQ sent at registration awaits a reply.
+	auth       SASLClient   // SASL mechanism in use, or nil.
+	authIdx    int          // index of auth in auths.
+	authMech   string       // name of the mechanism of auth.
+	authBuf    string       // AUTHENTICATE payload being received in chunks.
+	saslMechs  []string     // mechanisms given by RPL_SASLMECHS, if any.
 
 	availableCaps map[string]string
 	enabledCaps   map[string]struct{}
@@ -121,18 +194,33 @@ type Session struct {
 	chanmodes     [4]string
 	chantypes     string
 	linelen       int
+	modesPerLine  int // the number of modes with a parameter a MODE can hold.
 	historyLimit  int
 	prefixSymbols string
 	prefixModes   string
+	monitorLimit  int    // -1 if MONITOR is not supported, 0 if unlimited.
+	whox          bool   // whether WHO supports the WHOX syntax.
+	elist         string // the conditions LIST supports, upper-cased.
 
 	users          map[string]*User        // known users.
+	nickAccounts   map[string]string       // accounts nicks have been seen logged in to.
 	channels       map[string]Channel      // joined channels.
 	chBatches      map[string]HistoryEvent // channel history batches being processed.
 	chReqs         map[string]struct{}     // set of targets for which history is currently requested.
 	targetsBatchID string                  // ID of the channel history targets batch being processed.
 	targetsBatch   HistoryTargetsEvent     // channel history targets batch being processed.
 
-	pendingChannels map[string]time.Time // set of join requests stamps for channels.
+	pendingChannels map[string]time.Time    // set of join requests stamps for channels.
+	whois           map[string]WhoisEvent   // WHOIS replies being received.
+	modeLists       map[string][]ListEntry  // mode lists being received, by casemapped channel and mode.
+	listed          []ListedChannel         // LIST replies not sent as an event yet.
+	awayReplies     map[string]string       // last away message sent as UserAwayEvent, per user.
+	monitored       map[string]MonitorEntry // monitored users, by casemapped nick.
+
+	pingCount int           // number of PINGs sent, used to make their tokens.
+	pingToken string        // token of the unanswered PING, or "".
+	pingSent  time.Time     // when the unanswered PING has been sent.
+	lag       time.Duration // round-trip time of the last answered PING.
 }
 
 func NewSession(out chan<- Message, params SessionParams) *Session {
@@ -142,36 +230,43 @@ func NewSession(out chan<- Message, params SessionParams) *Session {
 		typingStamps:    map[string]typingStamp{},
 		nick:            params.Nickname,
 		nickCf:          CasemapASCII(params.Nickname),
+		altNicks:        params.AltNicknames,
+		nickWanted:      params.Nickname,
 		user:            params.Username,
 		real:            params.RealName,
 		netID:           params.NetID,
-		auth:            params.Auth,
+		auths:           params.Auths,
+		tls:             params.TLS,
+		noSTS:           params.NoSTS,
+		ctcpReplies:     params.CTCPReplies,
+		ctcpLimit:       rate.NewLimiter(rate.Every(2*time.Second), 3),
 		availableCaps:   map[string]string{},
 		enabledCaps:     map[string]struct{}{},
 		casemap:         CasemapRFC1459,
 		chantypes:       "#&",
 		linelen:         512,
+		modesPerLine:    3,
 		historyLimit:    100,
 		prefixSymbols:   "@+",
 		prefixModes:     "ov",
+		monitorLimit:    -1,
 		users:           map[string]*User{},
+		nickAccounts:    map[string]string{},
 		channels:        map[string]Channel{},
 		chBatches:       map[string]HistoryEvent{},
 		chReqs:          map[string]struct{}{},
 		pendingChannels: map[string]time.Time{},
+		whois:           map[string]WhoisEvent{},
+		modeLists:       map[string][]ListEntry{},
+		awayReplies:     map[string]string{},
+		monitored:       map[string]MonitorEntry{},
 	}
 
+	// Capabilities are requested once the server has listed them.
 	s.out <- NewMessage("CAP", "LS", "302")
-	for capability := range SupportedCapabilities {
-		s.out <- NewMessage("CAP", "REQ", capability)
-	}
 	s.out <- NewMessage("NICK", s.nick)
 	s.out <- NewMessage("USER", s.user, "0", "*", s.real)
 
-	if s.auth == nil {
-		s.endRegistration()
-	}
-
 	return s
 }
 
@@ -238,24 +333,37 @@ func (s *Session) Names(target string) []Member {
 					PowerLevel: pl,
 					Name:       u.Name.Copy(),
 					Away:       u.Away,
+					Account:    u.Account,
 				})
 			}
 		}
 	} else if u, ok := s.users[s.Casemap(target)]; ok {
 		names = append(names, Member{
-			Name: u.Name.Copy(),
-			Away: u.Away,
+			Name:    u.Name.Copy(),
+			Away:    u.Away,
+			Account: u.Account,
 		})
 		names = append(names, Member{
 			Name: &Prefix{
 				Name: s.nick,
 			},
+			Account: s.acct,
 		})
 	}
 	sort.Sort(members(names))
 	return names
 }
 
+// UserPrefix returns the nick, user and host of the given user, as far as they
+// are known.
+func (s *Session) UserPrefix(nick string) (p *Prefix, ok bool) {
+	u, ok := s.users[s.Casemap(nick)]
+	if !ok {
+		return nil, false
+	}
+	return u.Name.Copy(), true
+}
+
 // Typings returns the list of nickname who are currently typing.
 func (s *Session) Typings(target string) []string {
 	targetCf := s.casemap(target)
@@ -292,6 +400,12 @@ func (s *Session) ChannelsSharedWith(name string) []string {
 	return channels
 }
 
+// IsJoined reports whether we are in the given channel.
+func (s *Session) IsJoined(channel string) bool {
+	_, ok := s.channels[s.Casemap(channel)]
+	return ok
+}
+
 func (s *Session) Topic(channel string) (topic string, who *Prefix, at time.Time) {
 	channelCf := s.Casemap(channel)
 	if c, ok := s.channels[channelCf]; ok {
@@ -316,6 +430,30 @@ func (s *Session) Join(channel, key string) {
 	}
 }
 
+// JoinChannels joins the given channels, which have no key, in as few
+// messages as the server allows.
+func (s *Session) JoinChannels(channels []string) {
+	maxLen := s.linelen - len("JOIN \r\n")
+	var batch []string
+	var batchLen int
+	flush := func() {
+		if len(batch) != 0 {
+			s.out <- NewMessage("JOIN", strings.Join(batch, ","))
+		}
+		batch = nil
+		batchLen = 0
+	}
+	for _, channel := range channels {
+		if len(batch) != 0 && maxLen < batchLen+1+len(channel) {
+			flush()
+		}
+		s.pendingChannels[s.Casemap(channel)] = time.Now()
+		batch = append(batch, channel)
+		batchLen += 1 + len(channel)
+	}
+	flush()
+}
+
 func (s *Session) Part(channel, reason string) {
 	s.out <- NewMessage("PART", channel, reason)
 }
@@ -324,19 +462,161 @@ func (s *Session) ChangeTopic(channel, topic string) {
 	s.out <- NewMessage("TOPIC", channel, topic)
 }
 
+// Ping sends a PING to the server to measure the lag, unless the previous one
+// is still unanswered.
+func (s *Session) Ping() {
+	if !s.registered || s.pingToken != "" {
+		return
+	}
+	s.pingCount++
+	s.pingToken = fmt.Sprintf("senpai-%d", s.pingCount)
+	s.pingSent = time.Now()
+	s.out <- NewMessage("PING", s.pingToken)
+}
+
+// Lag returns the round-trip time of the last PING, or the time since the
+// unanswered PING has been sent if it is longer.
+func (s *Session) Lag() time.Duration {
+	if pending := s.PingPending(); s.lag < pending {
+		return pending
+	}
+	return s.lag
+}
+
+// PingPending returns the time since the unanswered PING has been sent, or 0
+// if all PINGs have been answered.
+func (s *Session) PingPending() time.Duration {
+	if s.pingToken == "" {
+		return 0
+	}
+	return time.Since(s.pingSent)
+}
+
 func (s *Session) Quit(reason string) {
 	s.out <- NewMessage("QUIT", reason)
 }
 
+// SetRealName changes our realname, if the server supports it.
+func (s *Session) SetRealName(realname string) error {
+	if _, ok := s.enabledCaps["setname"]; !ok {
+		return errors.New("the server does not support changing the realname")
+	}
+	s.out <- NewMessage("SETNAME", realname)
+	return nil
+}
+
+// SetAway marks us as being away with the given message, or as being back if
+// message is empty.
+func (s *Session) SetAway(message string) {
+	if message == "" {
+		s.out <- NewMessage("AWAY")
+	} else {
+		s.out <- NewMessage("AWAY", message)
+	}
+}
+
+// IsAway reports whether we are marked as being away.
+func (s *Session) IsAway() bool {
+	return s.away
+}
+
+// ChangeNick sends a NICK message.  If nick is taken, RegainNick will try to
+// get it later.
+// ChangeNick changes the nickname.  The configured nickname is no longer
+// regained, since another one is asked for.
 func (s *Session) ChangeNick(nick string) {
+	if s.Casemap(nick) != s.Casemap(s.nickWanted) {
+		s.nickWanted = ""
+	}
+	s.regaining = false
 	s.out <- NewMessage("NICK", nick)
 }
 
+// RegainNick tries to change the nickname back to the configured one, when it
+// was taken.  Failures are not reported, and it stops trying once the server
+// rejects the nickname as invalid.
+func (s *Session) RegainNick() {
+	if !s.registered || s.nickWanted == "" || s.IsMe(s.nickWanted) {
+		return
+	}
+	s.regaining = true
+	s.out <- NewMessage("NICK", s.nickWanted)
+}
+
 func (s *Session) ChangeMode(channel, flags string, args []string) {
 	args = append([]string{channel, flags}, args...)
 	s.out <- NewMessage("MODE", args...)
 }
 
+// ChangeModes sends the given mode changes to channel, in as few MODE messages
+// as the server allows.
+func (s *Session) ChangeModes(channel string, changes []ModeChange) {
+	maxLen := s.linelen - len("MODE  \r\n") - len(channel)
+	var flags []byte
+	var params []string
+	var paramsLen int
+	var enabled bool
+	flush := func() {
+		if len(flags) != 0 {
+			s.ChangeMode(channel, string(flags), params)
+		}
+		flags = nil
+		params = nil
+		paramsLen = 0
+	}
+	for _, change := range changes {
+		if change.Param != "" {
+			if (0 < s.modesPerLine && len(params) == s.modesPerLine) ||
+				maxLen < len(flags)+2+paramsLen+1+len(change.Param) {
+				flush()
+			}
+		}
+		if len(flags) == 0 || enabled != change.Enable {
+			enabled = change.Enable
+			if enabled {
+				flags = append(flags, '+')
+			} else {
+				flags = append(flags, '-')
+			}
+		}
+		flags = append(flags, change.Mode)
+		if change.Param != "" {
+			params = append(params, change.Param)
+			paramsLen += 1 + len(change.Param)
+		}
+	}
+	flush()
+}
+
+// HasListMode returns whether mode is a list mode of channels, such as 'b'
+// for bans.
+func (s *Session) HasListMode(mode byte) bool {
+	return mode == 'b' || 0 <= strings.IndexByte(s.chanmodes[ModeTypeA], mode)
+}
+
+// HasListCondition returns whether LIST supports the given condition, as
+// given by the ELIST feature: 'U' for user counts, 'M' for masks, 'N' for
+// negated masks, 'C' for creation times and 'T' for topic times.
+func (s *Session) HasListCondition(condition byte) bool {
+	return 0 <= strings.IndexByte(s.elist, condition)
+}
+
+// List asks the server for the list of channels matching the given
+// conditions.  The reply is sent in ChannelListEvents.
+func (s *Session) List(conditions ...string) {
+	if len(conditions) == 0 {
+		s.out <- NewMessage("LIST")
+	} else {
+		s.out <- NewMessage("LIST", strings.Join(conditions, ","))
+	}
+}
+
+// RequestModeList asks the server for the list of the given mode (e.g. 'b'
+// for bans) of channel.  The reply is a ModeListEvent.
+func (s *Session) RequestModeList(channel string, mode byte) {
+	s.out <- NewMessage("MODE", channel, "+"+string(mode))
+}
+
 func splitChunks(s string, chunkLen int) (chunks []string) {
 	if chunkLen <= 0 {
 		return []string{s}
@@ -357,6 +637,21 @@ func splitChunks(s string, chunkLen int) (chunks []string) {
 }
 
 func (s *Session) PrivMsg(target, content string) {
+	s.privMsg(target, content, nil)
+}
+
+// Reply sends content to target as a reply to the message whose msgid is
+// replyTo.  The reply is sent as a plain message if the server does not
+// support message tags.
+func (s *Session) Reply(target, replyTo, content string) {
+	if !s.HasCapability("message-tags") {
+		s.privMsg(target, content, nil)
+		return
+	}
+	s.privMsg(target, content, map[string]string{"+draft/reply": replyTo})
+}
+
+func (s *Session) privMsg(target, content string, tags map[string]string) {
 	hostLen := len(s.host)
 	if hostLen == 0 {
 		hostLen = len("255.255.255.255")
@@ -369,12 +664,121 @@ func (s *Session) PrivMsg(target, content string) {
 		len(target)
 	chunks := splitChunks(content, maxMessageLen)
 	for _, chunk := range chunks {
-		s.out <- NewMessage("PRIVMSG", target, chunk)
+		msg := NewMessage("PRIVMSG", target, chunk)
+		for k, v := range tags {
+			msg = msg.WithTag(k, v)
+		}
+		s.out <- msg
 	}
 	targetCf := s.Casemap(target)
 	delete(s.typingStamps, targetCf)
 }
 
+// React sends reaction to target, as a reaction to the message whose msgid is
+// replyTo.
+func (s *Session) React(target, replyTo, reaction string) error {
+	if !s.HasCapability("message-tags") {
+		return errors.New("the server does not support reactions")
+	}
+	s.out <- NewMessage("TAGMSG", target).
+		WithTag("+draft/reply", replyTo).
+		WithTag("+draft/react", reaction)
+	return nil
+}
+
+// HasMonitor reports whether the server supports MONITOR.
+func (s *Session) HasMonitor() bool {
+	return 0 <= s.monitorLimit
+}
+
+// Monitor adds the given nicks to the list of users we monitor.  If the server
+// has not told yet whether it supports MONITOR, they are sent once it does.
+func (s *Session) Monitor(nicks ...string) (err error) {
+	var added []string
+	for _, nick := range nicks {
+		nickCf := s.Casemap(nick)
+		if _, ok := s.monitored[nickCf]; ok {
+			continue
+		}
+		if 0 < s.monitorLimit && s.monitorLimit <= len(s.monitored) {
+			err = fmt.Errorf("cannot monitor more than %d users", s.monitorLimit)
+			break
+		}
+		s.monitored[nickCf] = MonitorEntry{Nick: nick}
+		added = append(added, nick)
+	}
+	if s.HasMonitor() {
+		s.sendMonitor("+", added)
+	}
+	return err
+}
+
+// Unmonitor removes the given nicks from the list of users we monitor.
+func (s *Session) Unmonitor(nicks ...string) {
+	var removed []string
+	for _, nick := range nicks {
+		nickCf := s.Casemap(nick)
+		if _, ok := s.monitored[nickCf]; !ok {
+			continue
+		}
+		delete(s.monitored, nickCf)
+		removed = append(removed, nick)
+	}
+	if s.HasMonitor() {
+		s.sendMonitor("-", removed)
+	}
+}
+
+// Monitored returns the users we monitor, sorted by nick.
+func (s *Session) Monitored() []MonitorEntry {
+	entries := make([]MonitorEntry, 0, len(s.monitored))
+	for _, e := range s.monitored {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return s.Casemap(entries[i].Nick) < s.Casemap(entries[j].Nick)
+	})
+	return entries
+}
+
+// sendMonitor sends MONITOR messages that add (op is "+") or remove (op is
+// "-") nicks, as few as the line length allows.
+func (s *Session) sendMonitor(op string, nicks []string) {
+	maxLen := s.linelen - len("MONITOR + \r\n")
+	var targets string
+	for _, nick := range nicks {
+		if targets != "" && maxLen < len(targets)+1+len(nick) {
+			s.out <- NewMessage("MONITOR", op, targets)
+			targets = ""
+		}
+		if targets != "" {
+			targets += ","
+		}
+		targets += nick
+	}
+	if targets != "" {
+		s.out <- NewMessage("MONITOR", op, targets)
+	}
+}
+
+// CTCP sends a CTCP request to target.
+func (s *Session) CTCP(target, command, params string) {
+	s.out <- NewMessage("PRIVMSG", target, CTCP(command, params))
+}
+
+// Redact deletes the message whose msgid is id from target.
+func (s *Session) Redact(target, id, reason string) error {
+	if !s.HasCapability("draft/message-redaction") {
+		return errors.New("the server does not support deleting messages")
+	}
+	if reason == "" {
+		s.out <- NewMessage("REDACT", target, id)
+	} else {
+		s.out <- NewMessage("REDACT", target, id, reason)
+	}
+	return nil
+}
+
 func (s *Session) Typing(target string) {
 	if !s.HasCapability("message-tags") {
 		return
@@ -490,6 +894,10 @@ func (s *Session) NewHistoryRequest(target string) *HistoryRequest {
 	}
 }
 
+func (s *Session) Whois(nick string) {
+	s.out <- NewMessage("WHOIS", nick)
+}
+
 func (s *Session) Invite(nick, channel string) {
 	s.out <- NewMessage("INVITE", nick, channel)
 }
@@ -512,13 +920,23 @@ func (s *Session) HandleMessage(msg Message) (Event, error) {
 
 func (s *Session) handleUnregistered(msg Message) (Event, error) {
 	switch msg.Command {
-	case errNicknameinuse:
+	case errNicknameinuse, errNickcollision:
 		var nick string
 		if err := msg.ParseParams(nil, &nick); err != nil {
 			return nil, err
 		}
 
-		s.out <- NewMessage("NICK", nick+"_")
+		// Try the alternative nicknames in order, then add underscores
+		// to the last one.
+		if len(s.altNicks) != 0 {
+			nick = s.altNicks[0]
+			s.altNicks = s.altNicks[1:]
+		} else {
+			nick += "_"
+		}
+		s.nick = nick
+		s.nickCf = CasemapASCII(nick)
+		s.out <- NewMessage("NICK", nick)
 	case rplSaslsuccess:
 		s.endRegistration()
 	default:
@@ -568,22 +986,56 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			return nil, err
 		}
 
+		// Payloads are split in chunks of 400 bytes, the last one
+		// being shorter or "+".
+		if len(payload) == authChunkLen {
+			s.authBuf += payload
+			break
+		}
+		if s.authBuf != "" {
+			if payload == "+" {
+				payload = ""
+			}
+			payload = s.authBuf + payload
+			s.authBuf = ""
+		}
+
 		res, err := s.auth.Respond(payload)
 		if err != nil {
 			s.out <- NewMessage("AUTHENTICATE", "*")
 		} else {
+			for len(res) >= authChunkLen {
+				s.out <- NewMessage("AUTHENTICATE", res[:authChunkLen])
+				res = res[authChunkLen:]
+			}
+			if res == "" {
+				res = "+"
+			}
 			s.out <- NewMessage("AUTHENTICATE", res)
 		}
 	case rplLoggedin:
-		var nuh string
-		if err := msg.ParseParams(nil, &nuh, &s.acct); err != nil {
+		var nuh, account string
+		if err := msg.ParseParams(nil, &nuh, &account); err != nil {
 			return nil, err
 		}
 
 		prefix := ParsePrefix(nuh)
 		s.user = prefix.User
 		s.host = prefix.Host
-	case errNicklocked, errSaslfail, errSasltoolong, errSaslaborted, errSaslalready, rplSaslmechs:
+		s.setAccount(s.nick, account)
+	case rplLoggedout:
+		s.setAccount(s.nick, "")
+	case rplSaslmechs:
+		var mechs string
+		if err := msg.ParseParams(nil, &mechs); err != nil {
+			return nil, err
+		}
+
+		s.saslMechs = strings.Split(mechs, ",")
+	case errNicklocked, errSaslfail, errSasltoolong, errSaslaborted, errSaslalready:
+		if msg.Command == errSaslfail && s.retryAuthentication() {
+			break
+		}
 		s.endRegistration()
 		return ErrorEvent{
 			Severity: SeverityFail,
@@ -599,7 +1051,7 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		s.registered = true
 		s.users[s.nickCf] = &User{Name: &Prefix{
 			Name: s.nick, User: s.user, Host: s.host,
-		}}
+		}, Account: s.acct, RealName: s.real}
 		if s.host == "" {
 			s.out <- NewMessage("WHO", s.nick)
 		}
@@ -609,22 +1061,189 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			return nil, msg.errNotEnoughParams(3)
 		}
 		s.updateFeatures(msg.Params[1 : len(msg.Params)-1])
+	case rplMononline, rplMonoffline:
+		var targets string
+		if err := msg.ParseParams(nil, &targets); err != nil {
+			return nil, err
+		}
+
+		ev := MonitorEvent{Online: msg.Command == rplMononline}
+		for _, target := range strings.Split(targets, ",") {
+			nick := ParsePrefix(target).Name
+			nickCf := s.Casemap(nick)
+			e, ok := s.monitored[nickCf]
+			if !ok {
+				continue
+			}
+			// Only tell about users that are online when we start
+			// monitoring them, then about changes.
+			if (e.Known && e.Online != ev.Online) || (!e.Known && ev.Online) {
+				ev.Users = append(ev.Users, nick)
+			}
+			s.monitored[nickCf] = MonitorEntry{
+				Nick:   nick,
+				Online: ev.Online,
+				Known:  true,
+			}
+		}
+		if len(ev.Users) != 0 {
+			return ev, nil
+		}
+	case rplMonlist, rplEndofmonlist:
+		// The list is kept up to date in s.monitored.
+	case errMonlistfull:
+		var limit, targets string
+		if err := msg.ParseParams(nil, &limit, &targets); err != nil {
+			return nil, err
+		}
+
+		for _, target := range strings.Split(targets, ",") {
+			delete(s.monitored, s.Casemap(target))
+		}
+		return ErrorEvent{
+			Severity: SeverityFail,
+			Code:     msg.Command,
+			Message:  fmt.Sprintf("Cannot monitor %s, the list is full (%s users at most)", targets, limit),
+		}, nil
 	case rplWhoreply:
-		var nick, host, flags, username string
-		if err := msg.ParseParams(nil, nil, &username, &host, nil, &nick, &flags, nil); err != nil {
+		var nick, host, flags, username, trailing string
+		if err := msg.ParseParams(nil, nil, &username, &host, nil, &nick, &flags, &trailing); err != nil {
 			return nil, err
 		}
 
-		nickCf := s.Casemap(nick)
-		away := flags[0] == 'G' // flags is not empty because it's not the trailing parameter
+		// The trailing parameter is "<hopcount> <realname>".
+		realname := ""
+		if i := strings.IndexByte(trailing, ' '); i >= 0 {
+			realname = trailing[i+1:]
+		}
+		s.updateWhoUser(nick, username, host, flags, realname)
+	case rplWhospcrpl:
+		var token, username, host, nick, flags, account, realname string
+		if err := msg.ParseParams(nil, &token, nil, &username, &host, &nick, &flags, &account, &realname); err != nil {
+			return nil, err
+		}
+		if token != whoxToken {
+			break
+		}
 
-		if s.nickCf == nickCf {
-			s.user = username
-			s.host = host
+		s.updateWhoUser(nick, username, host, flags, realname)
+		if account == "0" {
+			account = "*"
+		}
+		s.setAccount(nick, account)
+	case rplWhoisuser:
+		var nick, user, host, real string
+		if err := msg.ParseParams(nil, &nick, &user, &host, nil, &real); err != nil {
+			return nil, err
 		}
 
-		if u, ok := s.users[nickCf]; ok {
-			u.Away = away
+		w := s.whoisReply(nick)
+		w.User = user
+		w.Host = host
+		w.RealName = real
+		s.whois[s.Casemap(nick)] = w
+	case rplWhoisserver:
+		var nick, server, info string
+		if err := msg.ParseParams(nil, &nick, &server, &info); err != nil {
+			return nil, err
+		}
+
+		w := s.whoisReply(nick)
+		w.Server = server
+		w.ServerInfo = info
+		s.whois[s.Casemap(nick)] = w
+	case rplWhoisoperator:
+		var nick string
+		if err := msg.ParseParams(nil, &nick); err != nil {
+			return nil, err
+		}
+
+		w := s.whoisReply(nick)
+		w.Operator = true
+		s.whois[s.Casemap(nick)] = w
+	case rplWhoisidle:
+		var nick, idle string
+		if err := msg.ParseParams(nil, &nick, &idle); err != nil {
+			return nil, err
+		}
+
+		w := s.whoisReply(nick)
+		if seconds, err := strconv.ParseInt(idle, 10, 64); err == nil {
+			w.Idle = time.Duration(seconds) * time.Second
+		}
+		// The signon time is optional, the last parameter being text.
+		if len(msg.Params) > 4 {
+			if signon, err := strconv.ParseInt(msg.Params[3], 10, 64); err == nil {
+				w.Signon = time.Unix(signon, 0)
+			}
+		}
+		s.whois[s.Casemap(nick)] = w
+	case rplWhoischannels:
+		var nick, channels string
+		if err := msg.ParseParams(nil, &nick, &channels); err != nil {
+			return nil, err
+		}
+
+		w := s.whoisReply(nick)
+		w.Channels = append(w.Channels, strings.Fields(channels)...)
+		s.whois[s.Casemap(nick)] = w
+	case rplWhoisaccount:
+		var nick, account string
+		if err := msg.ParseParams(nil, &nick, &account); err != nil {
+			return nil, err
+		}
+
+		w := s.whoisReply(nick)
+		w.Account = account
+		s.whois[s.Casemap(nick)] = w
+	case rplWhoissecure:
+		var nick string
+		if err := msg.ParseParams(nil, &nick); err != nil {
+			return nil, err
+		}
+
+		w := s.whoisReply(nick)
+		w.Secure = true
+		s.whois[s.Casemap(nick)] = w
+	case rplAway:
+		var nick, message string
+		if err := msg.ParseParams(nil, &nick, &message); err != nil {
+			return nil, err
+		}
+
+		nickCf := s.Casemap(nick)
+		if w, ok := s.whois[nickCf]; ok {
+			w.Away = message
+			s.whois[nickCf] = w
+			break
+		}
+		// Otherwise, this is the reply to a message sent to nick.
+		if s.awayReplies[nickCf] == message {
+			break
+		}
+		s.awayReplies[nickCf] = message
+		return UserAwayEvent{
+			User:    nick,
+			Message: message,
+		}, nil
+	case rplUnaway, rplNowaway:
+		s.away = msg.Command == rplNowaway
+		if u, ok := s.users[s.nickCf]; ok {
+			u.Away = s.away
+		}
+		return SelfAwayEvent{
+			Away: s.away,
+		}, nil
+	case rplEndofwhois:
+		var nick string
+		if err := msg.ParseParams(nil, &nick); err != nil {
+			return nil, err
+		}
+
+		nickCf := s.Casemap(nick)
+		if w, ok := s.whois[nickCf]; ok {
+			delete(s.whois, nickCf)
+			return w, nil
 		}
 	case rplEndofwho:
 		// do nothing
@@ -635,7 +1254,27 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		}
 
 		switch subcommand {
+		case "LS":
+			// The capability list is the last parameter, after an
+			// optional "*" marking that more lines are to come.
+			caps = msg.Params[len(msg.Params)-1]
+			for _, c := range ParseCaps(caps) {
+				s.availableCaps[c.Name] = c.Value
+			}
+			ev, hasSTS := s.stsEvent(caps)
+			if hasSTS && !s.tls && !s.noSTS && ev.Policy.Port != 0 {
+				// The connection is to be closed and upgraded to TLS:
+				// send nothing sensitive through it.
+				s.stsUpgrade = true
+			}
+			if last := len(msg.Params) == 3; last && !s.registered && !s.stsUpgrade {
+				s.requestCaps()
+			}
+			if hasSTS {
+				return ev, nil
+			}
 		case "ACK":
+			sasl := false
 			for _, c := range ParseCaps(caps) {
 				if c.Enable {
 					s.enabledCaps[c.Name] = struct{}{}
@@ -643,9 +1282,8 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 					delete(s.enabledCaps, c.Name)
 				}
 
-				if s.auth != nil && c.Name == "sasl" {
-					h := s.auth.Handshake()
-					s.out <- NewMessage("AUTHENTICATE", h)
+				if c.Name == "sasl" {
+					sasl = c.Enable
 				} else if len(s.channels) != 0 && c.Name == "multi-prefix" {
 					// TODO merge NAMES commands
 					for channel := range s.channels {
@@ -653,8 +1291,25 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 					}
 				}
 			}
+			if !s.capReq || s.registered {
+				break
+			}
+			s.capReq = false
+			if !sasl || len(s.auths) == 0 {
+				s.endRegistration()
+			} else if !s.authenticate(0) {
+				s.endRegistration()
+				return ErrorEvent{
+					Severity: SeverityFail,
+					Code:     "SASL",
+					Message:  fmt.Sprintf("Registration failed: no supported SASL mechanism among %s", s.availableCaps["sasl"]),
+				}, nil
+			}
 		case "NAK":
-			// do nothing
+			if s.capReq && !s.registered {
+				s.capReq = false
+				s.endRegistration()
+			}
 		case "NEW":
 			for _, c := range ParseCaps(caps) {
 				s.availableCaps[c.Name] = c.Value
@@ -666,6 +1321,9 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				}
 				s.out <- NewMessage("CAP", "REQ", c.Name)
 			}
+			if ev, ok := s.stsEvent(caps); ok {
+				return ev, nil
+			}
 		case "DEL":
 			for _, c := range ParseCaps(caps) {
 				delete(s.availableCaps, c.Name)
@@ -687,6 +1345,7 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				User:    msg.Prefix.Name,
 				Channel: channel,
 				Time:    msg.TimeOrNow(),
+				ID:      msg.Tags["msgid"],
 			}, nil
 		}
 
@@ -694,25 +1353,22 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		channelCf := s.Casemap(channel)
 
 		if s.IsMe(nickCf) {
+			s.updateUser(msg)
 			s.channels[channelCf] = Channel{
 				Name:    msg.Params[0],
 				Members: map[*User]string{},
 			}
-			if _, ok := s.enabledCaps["away-notify"]; ok {
-				// Only try to know who is away if the list is
-				// updated by the server via away-notify.
-				// Otherwise, it'll become outdated over time.
-				s.out <- NewMessage("WHO", channel)
-			}
 		} else if c, ok := s.channels[channelCf]; ok {
 			if _, ok := s.users[nickCf]; !ok {
 				s.users[nickCf] = &User{Name: msg.Prefix.Copy()}
 			}
+			s.updateUser(msg)
 			c.Members[s.users[nickCf]] = ""
 			return UserJoinEvent{
 				User:    msg.Prefix.Name,
 				Channel: c.Name,
 				Time:    msg.TimeOrNow(),
+				ID:      msg.Tags["msgid"],
 			}, nil
 		}
 	case "PART":
@@ -720,16 +1376,21 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			return nil, errMissingPrefix
 		}
 
-		var channel string
+		var channel, reason string
 		if err := msg.ParseParams(&channel); err != nil {
 			return nil, err
 		}
+		if 1 < len(msg.Params) {
+			reason = msg.Params[1]
+		}
 
 		if playback {
 			return UserPartEvent{
 				User:    msg.Prefix.Name,
 				Channel: channel,
+				Reason:  reason,
 				Time:    msg.TimeOrNow(),
+				ID:      msg.Tags["msgid"],
 			}, nil
 		}
 
@@ -754,21 +1415,33 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				return UserPartEvent{
 					User:    u.Name.Name,
 					Channel: c.Name,
+					Reason:  reason,
 					Time:    msg.TimeOrNow(),
+					ID:      msg.Tags["msgid"],
 				}, nil
 			}
 		}
 	case "KICK":
-		var channel, nick string
+		if msg.Prefix == nil {
+			return nil, errMissingPrefix
+		}
+
+		var channel, nick, comment string
 		if err := msg.ParseParams(&channel, &nick); err != nil {
 			return nil, err
 		}
+		if 2 < len(msg.Params) {
+			comment = msg.Params[2]
+		}
 
 		if playback {
-			return UserPartEvent{
+			return UserKickEvent{
 				User:    nick,
+				Kicker:  msg.Prefix.Name,
 				Channel: channel,
+				Comment: comment,
 				Time:    msg.TimeOrNow(),
+				ID:      msg.Tags["msgid"],
 			}, nil
 		}
 
@@ -781,8 +1454,11 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				for u := range c.Members {
 					s.cleanUser(u)
 				}
-				return SelfPartEvent{
+				return SelfKickEvent{
+					Kicker:  msg.Prefix.Name,
 					Channel: c.Name,
+					Comment: comment,
+					Time:    msg.TimeOrNow(),
 				}, nil
 			}
 		} else if c, ok := s.channels[channelCf]; ok {
@@ -790,10 +1466,13 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				delete(c.Members, u)
 				s.cleanUser(u)
 				s.typings.Done(channelCf, nickCf)
-				return UserPartEvent{
-					User:    nick,
+				return UserKickEvent{
+					User:    u.Name.Name,
+					Kicker:  msg.Prefix.Name,
 					Channel: c.Name,
+					Comment: comment,
 					Time:    msg.TimeOrNow(),
+					ID:      msg.Tags["msgid"],
 				}, nil
 			}
 		}
@@ -802,10 +1481,17 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			return nil, errMissingPrefix
 		}
 
+		var reason string
+		if 0 < len(msg.Params) {
+			reason = msg.Params[0]
+		}
+
 		if playback {
 			return UserQuitEvent{
-				User: msg.Prefix.Name,
-				Time: msg.TimeOrNow(),
+				User:   msg.Prefix.Name,
+				Reason: reason,
+				Time:   msg.TimeOrNow(),
+				ID:     msg.Tags["msgid"],
 			}, nil
 		}
 
@@ -824,7 +1510,9 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			return UserQuitEvent{
 				User:     u.Name.Name,
 				Channels: channels,
+				Reason:   reason,
 				Time:     msg.TimeOrNow(),
+				ID:       msg.Tags["msgid"],
 			}, nil
 		}
 	case rplNamreply:
@@ -866,6 +1554,17 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			if stamp, ok := s.pendingChannels[channelCf]; ok && time.Since(stamp) < 5*time.Second {
 				ev.Requested = true
 			}
+			s.out <- NewMessage("MODE", c.Name)
+			if s.whox {
+				// Know the hosts, accounts and away states of members
+				// right away.
+				s.out <- NewMessage("WHO", c.Name, "%tcuhnfar,"+whoxToken)
+			} else if _, ok := s.enabledCaps["away-notify"]; ok {
+				// Only try to know who is away if the list is
+				// updated by the server via away-notify.
+				// Otherwise, it'll become outdated over time.
+				s.out <- NewMessage("WHO", c.Name)
+			}
 			return ev, nil
 		}
 	case rplTopic:
@@ -923,6 +1622,7 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				Channel: channel,
 				Topic:   topic,
 				Time:    msg.TimeOrNow(),
+				ID:      msg.Tags["msgid"],
 			}, nil
 		}
 
@@ -937,6 +1637,7 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				Channel: c.Name,
 				Topic:   c.Topic,
 				Time:    msg.TimeOrNow(),
+				ID:      msg.Tags["msgid"],
 			}, nil
 		}
 	case "MODE":
@@ -944,14 +1645,20 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		if err := msg.ParseParams(&channel, nil); err != nil {
 			return nil, err
 		}
-		mode := strings.Join(msg.Params[1:], " ")
+
+		ev := ModeChangeEvent{
+			Channel: channel,
+			Mode:    strings.Join(msg.Params[1:], " "),
+			Time:    msg.TimeOrNow(),
+			ID:      msg.Tags["msgid"],
+		}
+		if msg.Prefix != nil {
+			ev.User = msg.Prefix.Name
+		}
 
 		if playback {
-			return ModeChangeEvent{
-				Channel: channel,
-				Mode:    mode,
-				Time:    msg.TimeOrNow(),
-			}, nil
+			ev.Changes, _ = ParseChannelMode(msg.Params[1], msg.Params[2:], s.chanmodes, s.prefixModes)
+			return ev, nil
 		}
 
 		channelCf := s.Casemap(channel)
@@ -964,6 +1671,7 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			for _, change := range modeChanges {
 				i := strings.IndexByte(s.prefixModes, change.Mode)
 				if i < 0 {
+					s.updateChannelMode(&c, change)
 					continue
 				}
 				nickCf := s.Casemap(change.Param)
@@ -987,11 +1695,97 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				c.Members[user] = string(newMembership)
 			}
 			s.channels[channelCf] = c
-			return ModeChangeEvent{
-				Channel: c.Name,
-				Mode:    mode,
-				Time:    msg.TimeOrNow(),
-			}, nil
+			ev.Channel = c.Name
+			ev.Changes = modeChanges
+			return ev, nil
+		}
+	case rplChannelmodeis:
+		var channel, mode string
+		if err := msg.ParseParams(nil, &channel, &mode); err != nil {
+			return nil, err
+		}
+
+		channelCf := s.Casemap(channel)
+
+		if c, ok := s.channels[channelCf]; ok {
+			modeChanges, err := ParseChannelMode(mode, msg.Params[3:], s.chanmodes, s.prefixModes)
+			if err != nil {
+				return nil, err
+			}
+			c.Modes = nil
+			for _, change := range modeChanges {
+				s.updateChannelMode(&c, change)
+			}
+			s.channels[channelCf] = c
+			return ChannelModesEvent{Channel: c.Name}, nil
+		}
+	case rplListstart:
+		s.listed = nil
+	case rplList:
+		var channel, users, topic string
+		if err := msg.ParseParams(nil, &channel, &users, &topic); err != nil {
+			return nil, err
+		}
+
+		count, _ := strconv.Atoi(users)
+		s.listed = append(s.listed, ListedChannel{
+			Name:  channel,
+			Users: count,
+			Topic: topic,
+		})
+		if len(s.listed) == listBatchSize {
+			ev := ChannelListEvent{Channels: s.listed}
+			s.listed = nil
+			return ev, nil
+		}
+	case rplListend:
+		ev := ChannelListEvent{Channels: s.listed, Done: true}
+		s.listed = nil
+		return ev, nil
+	case rplBanlist, rplExceptlist, rplInvitelist:
+		var channel, mask string
+		if err := msg.ParseParams(nil, &channel, &mask); err != nil {
+			return nil, err
+		}
+
+		entry := ListEntry{Mask: mask}
+		if 5 <= len(msg.Params) {
+			entry.SetBy = msg.Params[3]
+			if seconds, err := strconv.ParseInt(msg.Params[4], 10, 64); err == nil && seconds != 0 {
+				entry.SetAt = time.Unix(seconds, 0)
+			}
+		}
+		key := s.Casemap(channel) + " " + string(modeListMode(msg.Command))
+		s.modeLists[key] = append(s.modeLists[key], entry)
+	case rplEndofbanlist, rplEndofexceptlist, rplEndofinvitelist:
+		var channel string
+		if err := msg.ParseParams(nil, &channel); err != nil {
+			return nil, err
+		}
+
+		mode := modeListMode(msg.Command)
+		key := s.Casemap(channel) + " " + string(mode)
+		entries := s.modeLists[key]
+		delete(s.modeLists, key)
+		if c, ok := s.channels[s.Casemap(channel)]; ok {
+			channel = c.Name
+		}
+		return ModeListEvent{
+			Channel: channel,
+			Mode:    mode,
+			Entries: entries,
+		}, nil
+	case rplCreationtime:
+		var channel, created string
+		if err := msg.ParseParams(nil, &channel, &created); err != nil {
+			return nil, err
+		}
+
+		channelCf := s.Casemap(channel)
+		seconds, err := strconv.ParseInt(created, 10, 64)
+		if c, ok := s.channels[channelCf]; ok && err == nil {
+			c.Created = time.Unix(seconds, 0)
+			s.channels[channelCf] = c
 		}
 	case "INVITE":
 		if msg.Prefix == nil {
@@ -1029,16 +1823,37 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		if u, ok := s.users[nickCf]; ok {
 			u.Away = len(msg.Params) == 1
 		}
+		if len(msg.Params) == 0 {
+			delete(s.awayReplies, nickCf)
+		}
+	case "ACCOUNT":
+		if msg.Prefix == nil {
+			return nil, errMissingPrefix
+		}
+
+		var account string
+		if err := msg.ParseParams(&account); err != nil {
+			return nil, err
+		}
+
+		s.setAccount(msg.Prefix.Name, account)
 	case "PRIVMSG", "NOTICE":
 		if msg.Prefix == nil {
 			return nil, errMissingPrefix
 		}
 
-		var target string
-		if err := msg.ParseParams(&target); err != nil {
+		var target, content string
+		if err := msg.ParseParams(&target, &content); err != nil {
 			return nil, err
 		}
 
+		if command, params, ok := ParseCTCP(content); ok && command != "ACTION" {
+			if playback {
+				return nil, nil
+			}
+			return s.handleCTCP(msg, target, command, params), nil
+		}
+
 		if playback {
 			return s.newMessageEvent(msg)
 		}
@@ -1049,10 +1864,6 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 
 		return s.newMessageEvent(msg)
 	case "TAGMSG":
-		if playback {
-			return nil, nil
-		}
-
 		if msg.Prefix == nil {
 			return nil, errMissingPrefix
 		}
@@ -1062,6 +1873,30 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			return nil, err
 		}
 
+		if reaction, ok := msg.Tags["+draft/react"]; ok {
+			replyTo := msg.Tags["+draft/reply"]
+			if reaction == "" || replyTo == "" {
+				return nil, nil
+			}
+			ev := ReactionEvent{
+				User:     msg.Prefix.Name,
+				Target:   target,
+				ReplyTo:  replyTo,
+				Reaction: reaction,
+				Time:     msg.TimeOrNow(),
+				ID:       msg.Tags["msgid"],
+			}
+			if c, ok := s.channels[s.Casemap(target)]; ok {
+				ev.Target = c.Name
+				ev.TargetIsChannel = true
+			}
+			return ev, nil
+		}
+
+		if playback {
+			return nil, nil
+		}
+
 		targetCf := s.casemap(target)
 		nickCf := s.casemap(msg.Prefix.Name)
 
@@ -1078,6 +1913,31 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				s.typings.Done(targetCf, nickCf)
 			}
 		}
+	case "REDACT":
+		if msg.Prefix == nil {
+			return nil, errMissingPrefix
+		}
+
+		var target, id, reason string
+		if err := msg.ParseParams(&target, &id); err != nil {
+			return nil, err
+		}
+		if 2 < len(msg.Params) {
+			reason = msg.Params[2]
+		}
+
+		ev := RedactEvent{
+			User:     msg.Prefix.Name,
+			Target:   target,
+			Redacted: id,
+			Reason:   reason,
+			Time:     msg.TimeOrNow(),
+		}
+		if c, ok := s.channels[s.Casemap(target)]; ok {
+			ev.Target = c.Name
+			ev.TargetIsChannel = true
+		}
+		return ev, nil
 	case "BATCH":
 		var id string
 		if err := msg.ParseParams(&id); err != nil {
@@ -1134,6 +1994,7 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				User:       nick,
 				FormerNick: msg.Prefix.Name,
 				Time:       msg.TimeOrNow(),
+				ID:         msg.Tags["msgid"],
 			}, nil
 		}
 
@@ -1152,6 +2013,7 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		if s.IsMe(msg.Prefix.Name) {
 			s.nick = newNick
 			s.nickCf = newNickCf
+			s.regaining = false
 			return SelfNickEvent{
 				FormerNick: msg.Prefix.Name,
 			}, nil
@@ -1160,8 +2022,70 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				User:       nick,
 				FormerNick: msg.Prefix.Name,
 				Time:       msg.TimeOrNow(),
+				ID:         msg.Tags["msgid"],
 			}, nil
 		}
+	case "CHGHOST":
+		if msg.Prefix == nil {
+			return nil, errMissingPrefix
+		}
+
+		var user, host string
+		if err := msg.ParseParams(&user, &host); err != nil {
+			return nil, err
+		}
+
+		ev := UserHostEvent{
+			User:       msg.Prefix.Name,
+			FormerHost: msg.Prefix.User + "@" + msg.Prefix.Host,
+			Host:       user + "@" + host,
+			Time:       msg.TimeOrNow(),
+			ID:         msg.Tags["msgid"],
+		}
+		if playback {
+			return ev, nil
+		}
+
+		if s.IsMe(msg.Prefix.Name) {
+			s.user = user
+			s.host = host
+		}
+		if u, ok := s.users[s.Casemap(msg.Prefix.Name)]; ok {
+			u.Name.User = user
+			u.Name.Host = host
+		}
+		return ev, nil
+	case "SETNAME":
+		if msg.Prefix == nil {
+			return nil, errMissingPrefix
+		}
+
+		var realname string
+		if err := msg.ParseParams(&realname); err != nil {
+			return nil, err
+		}
+
+		ev := UserRealNameEvent{
+			User:     msg.Prefix.Name,
+			RealName: realname,
+			Time:     msg.TimeOrNow(),
+			ID:       msg.Tags["msgid"],
+		}
+		if playback {
+			return ev, nil
+		}
+
+		if s.IsMe(msg.Prefix.Name) {
+			ev.FormerRealName = s.real
+			s.real = realname
+		}
+		if u, ok := s.users[s.Casemap(msg.Prefix.Name)]; ok {
+			if u.RealName != "" {
+				ev.FormerRealName = u.RealName
+			}
+			u.RealName = realname
+		}
+		return ev, nil
 	case "BOUNCER":
 		if len(msg.Params) < 3 {
 			break
@@ -1182,6 +2106,28 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		}
 
 		s.out <- NewMessage("PONG", payload)
+	case "PONG":
+		if len(msg.Params) == 0 || s.pingToken == "" {
+			break
+		}
+		if msg.Params[len(msg.Params)-1] == s.pingToken {
+			s.lag = time.Since(s.pingSent)
+			s.pingToken = ""
+		}
+	case errNicknameinuse, errNickcollision, errErroneusnickname:
+		var nick string
+		if err := msg.ParseParams(nil, &nick); err != nil {
+			return nil, err
+		}
+
+		if s.regaining && s.Casemap(nick) == s.Casemap(s.nickWanted) {
+			s.regaining = false
+			if msg.Command == errErroneusnickname {
+				s.nickWanted = ""
+			}
+			break
+		}
+		return replyEvent(msg)
 	case "ERROR":
 		s.Close()
 	case "FAIL", "WARN", "NOTE":
@@ -1207,19 +2153,61 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		}, nil
 	default:
 		if msg.IsReply() {
-			if len(msg.Params) < 2 {
-				return nil, msg.errNotEnoughParams(2)
+			if len(msg.Params) > 2 {
+				// Keep the other replies about a user in the middle of
+				// a WHOIS, such as the host they connect from, but not
+				// errors.
+				nickCf := s.Casemap(msg.Params[1])
+				if w, ok := s.whois[nickCf]; ok && msg.Command < "400" {
+					w.Info = append(w.Info, strings.Join(msg.Params[2:], " "))
+					s.whois[nickCf] = w
+					break
+				}
 			}
-			return ErrorEvent{
-				Severity: ReplySeverity(msg.Command),
-				Code:     msg.Command,
-				Message:  strings.Join(msg.Params[1:], " "),
-			}, nil
+			return replyEvent(msg)
 		}
 	}
 	return nil, nil
 }
 
+// whoisReply returns the WHOIS reply being received about nick, if any, or a
+// new one.
+func (s *Session) whoisReply(nick string) WhoisEvent {
+	if w, ok := s.whois[s.Casemap(nick)]; ok {
+		return w
+	}
+	return WhoisEvent{Nick: nick}
+}
+
+// replyEvent returns the ErrorEvent of a numeric reply that is not handled
+// otherwise.
+func replyEvent(msg Message) (Event, error) {
+	if len(msg.Params) < 2 {
+		return nil, msg.errNotEnoughParams(2)
+	}
+	return ErrorEvent{
+		Severity: ReplySeverity(msg.Command),
+		Code:     msg.Command,
+		Message:  strings.Join(msg.Params[1:], " "),
+	}, nil
+}
+
+// stsEvent returns the STS policy advertised in the given capability list, if
+// any.
+func (s *Session) stsEvent(caps string) (ev STSEvent, ok bool) {
+	for _, c := range ParseCaps(caps) {
+		if c.Name != "sts" {
+			continue
+		}
+		policy, err := ParseSTSPolicy(c.Value)
+		if err != nil {
+			return ev, false
+		}
+		return STSEvent{Policy: policy}, true
+	}
+	return ev, false
+}
+
 func (s *Session) newMessageEvent(msg Message) (ev MessageEvent, err error) {
 	if msg.Prefix == nil {
 		return ev, errMissingPrefix
@@ -1236,6 +2224,8 @@ func (s *Session) newMessageEvent(msg Message) (ev MessageEvent, err error) {
 		Command: msg.Command,
 		Content: content,
 		Time:    msg.TimeOrNow(),
+		ID:      msg.Tags["msgid"],
+		ReplyTo: msg.Tags["+draft/reply"],
 	}
 
 	targetCf := s.Casemap(target)
@@ -1244,9 +2234,162 @@ func (s *Session) newMessageEvent(msg Message) (ev MessageEvent, err error) {
 		ev.TargetIsChannel = true
 	}
 
+	nickCf := s.Casemap(ev.User)
+	if _, ok := s.enabledCaps["account-tag"]; ok {
+		// The tag is present if and only if the user is logged in,
+		// which tells impostors apart.
+		ev.Account = msg.Tags["account"]
+		if known, ok := s.nickAccounts[nickCf]; ok && known != ev.Account {
+			ev.Unidentified = true
+		} else if ev.Account != "" {
+			s.nickAccounts[nickCf] = ev.Account
+		}
+	} else if u, ok := s.users[nickCf]; ok {
+		ev.Account = u.Account
+		// Without the tag, accounts are only known for sure when their
+		// changes are followed and they have been given on join.
+		_, notify := s.enabledCaps["account-notify"]
+		_, extJoin := s.enabledCaps["extended-join"]
+		if notify && (extJoin || s.whox) {
+			if known, ok := s.nickAccounts[nickCf]; ok && known != u.Account {
+				ev.Unidentified = true
+			}
+		}
+	}
+
 	return ev, nil
 }
 
+// handleCTCP answers the CTCP request or returns the CTCP reply carried by msg.
+func (s *Session) handleCTCP(msg Message, target, command, params string) Event {
+	if msg.Command == "NOTICE" {
+		return CTCPReplyEvent{
+			User:    msg.Prefix.Name,
+			Command: command,
+			Params:  params,
+			Time:    msg.TimeOrNow(),
+		}
+	}
+
+	ev := CTCPEvent{
+		User:    msg.Prefix.Name,
+		Target:  target,
+		Command: command,
+		Params:  params,
+		Time:    msg.TimeOrNow(),
+	}
+	if s.IsMe(ev.User) {
+		return ev
+	}
+	if reply, ok := s.ctcpReplies.reply(command, params); ok && s.ctcpLimit.Allow() {
+		s.out <- NewMessage("NOTICE", ev.User, CTCP(command, reply))
+		ev.Replied = true
+	}
+	return ev
+}
+
+// modeListMode returns the channel mode of the list given by the reply command.
+func modeListMode(command string) byte {
+	switch command {
+	case rplExceptlist, rplEndofexceptlist:
+		return 'e'
+	case rplInvitelist, rplEndofinvitelist:
+		return 'I'
+	default:
+		return 'b'
+	}
+}
+
+// updateChannelMode applies change, which is not about membership, to c.
+func (s *Session) updateChannelMode(c *Channel, change ModeChange) {
+	if 0 <= strings.IndexByte(s.chanmodes[ModeTypeA], change.Mode) {
+		// Lists are not kept.
+		return
+	}
+	if c.Modes == nil {
+		c.Modes = map[byte]string{}
+	}
+	if change.Enable {
+		c.Modes[change.Mode] = change.Param
+	} else {
+		delete(c.Modes, change.Mode)
+	}
+	c.Key = c.Modes['k']
+	c.Limit, _ = strconv.Atoi(c.Modes['l'])
+}
+
+// ChannelModes returns the modes of the given channel as they would be set by
+// a MODE message (e.g. "+lnt 50"), the channel key aside.
+func (s *Session) ChannelModes(channel string) string {
+	c, ok := s.channels[s.Casemap(channel)]
+	if !ok || len(c.Modes) == 0 {
+		return ""
+	}
+	modes := make([]byte, 0, len(c.Modes))
+	for m := range c.Modes {
+		modes = append(modes, m)
+	}
+	sort.Slice(modes, func(i, j int) bool { return modes[i] < modes[j] })
+	var params []string
+	for _, m := range modes {
+		if p := c.Modes[m]; p != "" && m != 'k' {
+			params = append(params, p)
+		}
+	}
+	return strings.Join(append([]string{"+" + string(modes)}, params...), " ")
+}
+
+// updateWhoUser updates what is known of a user from a WHO reply.
+func (s *Session) updateWhoUser(nick, username, host, flags, realname string) {
+	nickCf := s.Casemap(nick)
+	away := strings.HasPrefix(flags, "G")
+
+	if s.nickCf == nickCf {
+		s.user = username
+		s.host = host
+	}
+
+	if u, ok := s.users[nickCf]; ok {
+		u.Name = &Prefix{Name: nick, User: username, Host: host}
+		u.Away = away
+		if realname != "" {
+			u.RealName = realname
+		}
+	}
+}
+
+// updateUser updates the account and realname of the author of msg, a JOIN,
+// if the server gives them with extended-join.
+func (s *Session) updateUser(msg Message) {
+	var account, realname string
+	if _, ok := s.enabledCaps["extended-join"]; !ok || msg.ParseParams(nil, &account, &realname) != nil {
+		return
+	}
+
+	s.setAccount(msg.Prefix.Name, account)
+	if u, ok := s.users[s.Casemap(msg.Prefix.Name)]; ok {
+		u.RealName = realname
+	}
+}
+
+// setAccount records the account nick is logged in to, given as "*" or "" if
+// not logged in.
+func (s *Session) setAccount(nick, account string) {
+	if account == "*" {
+		account = ""
+	}
+	nickCf := s.Casemap(nick)
+	if s.IsMe(nick) {
+		s.acct = account
+	}
+	if u, ok := s.users[nickCf]; ok {
+		u.Account = account
+	}
+	if account != "" {
+		s.nickAccounts[nickCf] = account
+	}
+}
+
 func (s *Session) cleanUser(parted *User) {
 	for _, c := range s.channels {
 		if _, ok := c.Members[parted]; ok {
@@ -1310,6 +2453,30 @@ func (s *Session) updateFeatures(features []string) {
 			if err == nil {
 				s.historyLimit = historyLimit
 			}
+		case "ELIST":
+			s.elist = strings.ToUpper(value)
+		case "MODES":
+			if value == "" {
+				s.modesPerLine = 0
+			} else if modes, err := strconv.Atoi(value); err == nil && 0 < modes {
+				s.modesPerLine = modes
+			}
+		case "MONITOR":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 0 {
+				limit = 0
+			}
+			supported := s.HasMonitor()
+			s.monitorLimit = limit
+			if !supported {
+				nicks := make([]string, 0, len(s.monitored))
+				for _, e := range s.Monitored() {
+					nicks = append(nicks, e.Nick)
+				}
+				s.sendMonitor("+", nicks)
+			}
+		case "WHOX":
+			s.whox = true
 		case "LINELEN":
 			linelen, err := strconv.Atoi(value)
 			if err == nil && linelen != 0 {
@@ -1335,6 +2502,89 @@ func (s *Session) updateFeatures(features []string) {
 	}
 }
 
+// authChunkLen is the maximum length of an AUTHENTICATE payload.
+const authChunkLen = 400
+
+// saslMechanisms returns the list of SASL mechanisms supported by the server,
+// or nil if unknown.
+func (s *Session) saslMechanisms() []string {
+	if s.saslMechs != nil {
+		return s.saslMechs
+	}
+	if mechs := s.availableCaps["sasl"]; mechs != "" {
+		return strings.Split(mechs, ",")
+	}
+	return nil
+}
+
+// authenticate starts SASL authentication with the strongest mechanism of
+// s.auths, starting at start, that the server supports.  It reports whether
+// such a mechanism has been found.
+func (s *Session) authenticate(start int) bool {
+	mechs := s.saslMechanisms()
+	for i := start; i < len(s.auths); i++ {
+		mech := s.auths[i].Handshake()
+		if mechs != nil && !containsFold(mechs, mech) {
+			continue
+		}
+		s.auth = s.auths[i]
+		s.authIdx = i
+		s.authMech = mech
+		s.authBuf = ""
+		s.out <- NewMessage("AUTHENTICATE", mech)
+		return true
+	}
+	s.auth = nil
+	return false
+}
+
+// retryAuthentication tries the next mechanism after a SASL failure, and
+// reports whether it did so.
+//
+// Failures of mechanisms advertised by the server are authentication
+// failures, which are not retried so that a password is not sent with a
+// weaker mechanism than the one that failed.
+func (s *Session) retryAuthentication() bool {
+	if s.auth == nil {
+		return false
+	}
+	if mechs := s.saslMechanisms(); mechs == nil || containsFold(mechs, s.authMech) {
+		return false
+	}
+	return s.authenticate(s.authIdx + 1)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestCaps requests the supported capabilities that the server has listed,
+// in a single message, then ends the registration once they are acknowledged.
+func (s *Session) requestCaps() {
+	var caps []string
+	for c := range SupportedCapabilities {
+		if _, ok := s.availableCaps[c]; !ok {
+			continue
+		}
+		if c == "sasl" && len(s.auths) == 0 {
+			continue
+		}
+		caps = append(caps, c)
+	}
+	if len(caps) == 0 {
+		s.endRegistration()
+		return
+	}
+	sort.Strings(caps)
+	s.out <- NewMessage("CAP", "REQ", strings.Join(caps, " "))
+	s.capReq = true
+}
+
 func (s *Session) endRegistration() {
 	if s.registered {
 		return
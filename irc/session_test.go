@@ -0,0 +1,982 @@
+package irc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSession returns a session that has just been created, along with
+// the channel it writes to.  The registration messages are discarded.
+func newTestSession(t *testing.T, params SessionParams) (*Session, chan Message) {
+	out := make(chan Message, 64)
+	s := NewSession(out, params)
+	drain(out)
+	t.Cleanup(s.Close)
+	return s, out
+}
+
+// requestedCaps returns the capabilities a new session requests at
+// registration from a server that supports them all.
+func requestedCaps(t *testing.T) map[string]struct{} {
+	s, out := newTestSession(t, SessionParams{Nickname: "senpai"})
+	var available []string
+	for c := range SupportedCapabilities {
+		available = append(available, c)
+	}
+	handle(t, s, ":irc.example.org CAP * LS :"+strings.Join(available, " "))
+	caps := map[string]struct{}{}
+	for {
+		select {
+		case msg := <-out:
+			if msg.Command == "CAP" && len(msg.Params) == 2 && msg.Params[0] == "REQ" {
+				for _, c := range strings.Fields(msg.Params[1]) {
+					caps[c] = struct{}{}
+				}
+			}
+		default:
+			return caps
+		}
+	}
+}
+
+// drain discards all messages queued in out.
+func drain(out chan Message) {
+	for {
+		select {
+		case <-out:
+		default:
+			return
+		}
+	}
+}
+
+func handle(t *testing.T, s *Session, line string) Event {
+	msg, err := ParseMessage(line)
+	if err != nil {
+		t.Fatalf("%q: %v", line, err)
+	}
+	ev, err := s.HandleMessage(msg)
+	if err != nil {
+		t.Fatalf("%q: %v", line, err)
+	}
+	return ev
+}
+
+func assertSent(t *testing.T, out chan Message, expected ...string) {
+	t.Helper()
+	for _, e := range expected {
+		select {
+		case msg := <-out:
+			if actual := msg.String(); actual != e {
+				t.Errorf("expected %q to be sent, got %q", e, actual)
+			}
+		default:
+			t.Errorf("expected %q to be sent, got nothing", e)
+		}
+	}
+	select {
+	case msg := <-out:
+		t.Errorf("expected nothing else to be sent, got %q", msg.String())
+	default:
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	out := make(chan Message, 64)
+	s := NewSession(out, SessionParams{Nickname: "senpai", Username: "senpai", RealName: "senpai"})
+	t.Cleanup(s.Close)
+	assertSent(t, out, "CAP LS 302", "NICK senpai", "USER senpai 0 * senpai")
+
+	// Supported capabilities are requested at once, sasl only to log in.
+	handle(t, s, ":irc.example.org CAP * LS * :away-notify sasl unknown")
+	assertSent(t, out)
+	handle(t, s, ":irc.example.org CAP * LS :server-time")
+	assertSent(t, out, "CAP REQ :away-notify server-time")
+	handle(t, s, ":irc.example.org CAP * ACK :away-notify server-time")
+	assertSent(t, out, "CAP END")
+	if !s.HasCapability("server-time") {
+		t.Errorf("expected server-time to be enabled")
+	}
+}
+
+func TestJoinChannels(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{Nickname: "senpai"})
+	s.linelen = 32
+	s.JoinChannels([]string{"#senpai", "#kouhai", "#sensei", "#tomodachi"})
+	assertSent(t, out, "JOIN #senpai,#kouhai,#sensei", "JOIN #tomodachi")
+}
+
+func TestSASLExternal(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{
+		Nickname: "senpai",
+		Username: "senpai",
+		RealName: "senpai",
+		Auths:    []SASLClient{&SASLExternal{}},
+		TLS:      true,
+	})
+
+	handle(t, s, ":irc.example.org CAP * LS :sasl")
+	assertSent(t, out, "CAP REQ sasl")
+	handle(t, s, ":irc.example.org CAP * ACK sasl")
+	assertSent(t, out, "AUTHENTICATE EXTERNAL")
+
+	handle(t, s, "AUTHENTICATE +")
+	assertSent(t, out, "AUTHENTICATE +")
+
+	handle(t, s, ":irc.example.org 900 senpai senpai!senpai@example.org senpai :You are now logged in as senpai")
+	handle(t, s, ":irc.example.org 903 senpai :SASL authentication successful")
+	assertSent(t, out, "CAP END")
+}
+
+func TestSASLMechanismNegotiation(t *testing.T) {
+	params := SessionParams{
+		Nickname: "senpai",
+		Username: "senpai",
+		RealName: "senpai",
+		Auths: []SASLClient{
+			&SASLExternal{},
+			&SASLScram{Username: "senpai", Password: "hunter2"},
+			&SASLPlain{Username: "senpai", Password: "hunter2"},
+		},
+		TLS: true,
+	}
+
+	s, out := newTestSession(t, params)
+	handle(t, s, ":irc.example.org CAP * LS * :multi-prefix sasl=PLAIN,SCRAM-SHA-256")
+	handle(t, s, ":irc.example.org CAP * LS :server-time")
+	assertSent(t, out, "CAP REQ :multi-prefix sasl server-time")
+	handle(t, s, ":irc.example.org CAP * ACK :multi-prefix sasl server-time")
+	assertSent(t, out, "AUTHENTICATE SCRAM-SHA-256")
+
+	// Without a list of mechanisms, try them in order, falling back on
+	// the next one when the server lists the ones it supports.
+	s, out = newTestSession(t, params)
+	handle(t, s, ":irc.example.org CAP * LS :sasl")
+	assertSent(t, out, "CAP REQ sasl")
+	handle(t, s, ":irc.example.org CAP * ACK sasl")
+	assertSent(t, out, "AUTHENTICATE EXTERNAL")
+	handle(t, s, ":irc.example.org 908 senpai PLAIN :are available SASL mechanisms")
+	handle(t, s, ":irc.example.org 904 senpai :SASL authentication failed")
+	assertSent(t, out, "AUTHENTICATE PLAIN")
+
+	// A failure of a mechanism the server supports is final.
+	handle(t, s, "AUTHENTICATE +")
+	assertSent(t, out, "AUTHENTICATE "+b64("senpai\x00senpai\x00hunter2"))
+	ev := handle(t, s, ":irc.example.org 904 senpai :SASL authentication failed")
+	if _, ok := ev.(ErrorEvent); !ok {
+		t.Errorf("expected an ErrorEvent, got %#v", ev)
+	}
+	assertSent(t, out, "CAP END")
+
+	s, out = newTestSession(t, params)
+	handle(t, s, ":irc.example.org CAP * LS :sasl=OAUTHBEARER")
+	assertSent(t, out, "CAP REQ sasl")
+	ev = handle(t, s, ":irc.example.org CAP * ACK sasl")
+	if _, ok := ev.(ErrorEvent); !ok {
+		t.Errorf("expected an ErrorEvent, got %#v", ev)
+	}
+	assertSent(t, out, "CAP END")
+}
+
+func TestSASLWithoutTLS(t *testing.T) {
+	params := SessionParams{
+		Nickname: "senpai",
+		Username: "senpai",
+		RealName: "senpai",
+		Auths:    []SASLClient{&SASLPlain{Username: "senpai", Password: "hunter2"}},
+	}
+	// The server requires TLS: stop there, the connection is upgraded.
+	s, out := newTestSession(t, params)
+	ev := handle(t, s, ":irc.example.org CAP * LS * :sts=port=6697,duration=300")
+	if _, ok := ev.(STSEvent); !ok {
+		t.Errorf("expected an STSEvent, got %#v", ev)
+	}
+	handle(t, s, ":irc.example.org CAP * LS :sasl=PLAIN")
+	handle(t, s, ":irc.example.org CAP * ACK sasl")
+	assertSent(t, out)
+
+	// STS does not apply to WebSocket connections.
+	params.NoSTS = true
+	s, out = newTestSession(t, params)
+	handle(t, s, ":irc.example.org CAP * LS :sts=port=6697 sasl=PLAIN")
+	assertSent(t, out, "CAP REQ sasl")
+	params.NoSTS = false
+
+	s, out = newTestSession(t, params)
+	handle(t, s, ":irc.example.org CAP * LS :sasl=PLAIN")
+	assertSent(t, out, "CAP REQ sasl")
+	handle(t, s, ":irc.example.org CAP * ACK sasl")
+	assertSent(t, out, "AUTHENTICATE PLAIN")
+
+	s, out = newTestSession(t, params)
+	handle(t, s, ":irc.example.org CAP * LS :batch")
+	assertSent(t, out, "CAP REQ batch")
+	handle(t, s, ":irc.example.org CAP * NAK batch")
+	assertSent(t, out, "CAP END")
+}
+
+func TestParseSTSPolicy(t *testing.T) {
+	policy, err := ParseSTSPolicy("port=6697,duration=300,preload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := STSPolicy{Port: 6697, Duration: 300 * time.Second, HasDuration: true, Preload: true}
+	if policy != expected {
+		t.Errorf("expected %+v, got %+v", expected, policy)
+	}
+
+	for _, value := range []string{"port=abc", "port=70000", "duration=-1", "duration"} {
+		if _, err := ParseSTSPolicy(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestSTSEvent(t *testing.T) {
+	s, _ := newTestSession(t, SessionParams{Nickname: "senpai"})
+	ev := handle(t, s, ":irc.example.org CAP * LS :multi-prefix sts=port=6697")
+	sts, ok := ev.(STSEvent)
+	if !ok {
+		t.Fatalf("expected an STSEvent, got %#v", ev)
+	}
+	if sts.Policy.Port != 6697 || sts.Policy.HasDuration {
+		t.Errorf("unexpected policy %+v", sts.Policy)
+	}
+
+	ev = handle(t, s, ":irc.example.org CAP senpai NEW :sts=duration=0")
+	if sts, ok := ev.(STSEvent); !ok || !sts.Policy.HasDuration || sts.Policy.Duration != 0 {
+		t.Errorf("expected a policy removal, got %#v", ev)
+	}
+}
+
+func TestPing(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{Nickname: "senpai"})
+
+	s.Ping()
+	assertSent(t, out) // not registered yet
+
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	drain(out)
+
+	s.Ping()
+	assertSent(t, out, "PING senpai-1")
+	s.Ping()
+	assertSent(t, out) // the previous PING is unanswered
+	if s.PingPending() == 0 {
+		t.Error("expected a PING to be pending")
+	}
+
+	handle(t, s, ":irc.example.org PONG irc.example.org :senpai-0")
+	if s.PingPending() == 0 {
+		t.Error("expected a PONG with another token to be ignored")
+	}
+
+	time.Sleep(time.Millisecond)
+	handle(t, s, ":irc.example.org PONG irc.example.org :senpai-1")
+	if s.PingPending() != 0 {
+		t.Error("expected the PING to be answered")
+	}
+	if s.Lag() < time.Millisecond {
+		t.Errorf("expected a lag of at least 1ms, got %s", s.Lag())
+	}
+
+	s.Ping()
+	assertSent(t, out, "PING senpai-2")
+}
+
+func TestAltNicknames(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{
+		Nickname:     "senpai",
+		AltNicknames: []string{"kouhai", "sensei"},
+	})
+
+	handle(t, s, ":irc.example.org 433 * senpai :Nickname is already in use")
+	assertSent(t, out, "NICK kouhai")
+	handle(t, s, ":irc.example.org 436 * kouhai :Nickname collision KILL")
+	assertSent(t, out, "NICK sensei")
+	handle(t, s, ":irc.example.org 433 * sensei :Nickname is already in use")
+	assertSent(t, out, "NICK sensei_")
+	handle(t, s, ":irc.example.org 433 * sensei_ :Nickname is already in use")
+	assertSent(t, out, "NICK sensei__")
+	if s.Nick() != "sensei__" {
+		t.Errorf("expected the nickname to be sensei__, got %q", s.Nick())
+	}
+
+	handle(t, s, ":irc.example.org 001 sensei__ :Welcome")
+	drain(out)
+	if !s.IsMe("sensei__") {
+		t.Errorf("expected the nickname to be sensei__, got %q", s.Nick())
+	}
+
+	// Failures to regain the nickname are silent.
+	s.RegainNick()
+	assertSent(t, out, "NICK senpai")
+	if ev := handle(t, s, ":irc.example.org 433 sensei__ senpai :Nickname is already in use"); ev != nil {
+		t.Errorf("expected no event, got %#v", ev)
+	}
+
+	s.RegainNick()
+	assertSent(t, out, "NICK senpai")
+	ev := handle(t, s, ":sensei__!senpai@example.org NICK senpai")
+	if ev, ok := ev.(SelfNickEvent); !ok || ev.FormerNick != "sensei__" {
+		t.Errorf("expected a SelfNickEvent, got %#v", ev)
+	}
+	if !s.IsMe("senpai") {
+		t.Errorf("expected the nickname to be senpai, got %q", s.Nick())
+	}
+
+	s.RegainNick()
+	assertSent(t, out) // nothing to regain
+}
+
+func TestChangeNickTaken(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{Nickname: "senpai"})
+	handle(t, s, ":irc.example.org 433 * senpai :Nickname is already in use")
+	handle(t, s, ":irc.example.org 001 senpai_ :Welcome")
+	drain(out)
+
+	// Failures of explicit changes are reported, and only the configured
+	// nickname is regained, until another one is asked for.
+	s.ChangeNick("sensei")
+	assertSent(t, out, "NICK sensei")
+	ev := handle(t, s, ":irc.example.org 433 senpai_ sensei :Nickname is already in use")
+	if ev, ok := ev.(ErrorEvent); !ok || ev.Code != errNicknameinuse {
+		t.Errorf("expected an ErrorEvent, got %#v", ev)
+	}
+	s.RegainNick()
+	assertSent(t, out)
+}
+
+func TestRegainInvalidNick(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{Nickname: "senpai"})
+	handle(t, s, ":irc.example.org 433 * senpai :Nickname is already in use")
+	handle(t, s, ":irc.example.org 001 senpai_ :Welcome")
+	drain(out)
+
+	// The server rejects the configured nickname: stop trying for good.
+	s.RegainNick()
+	assertSent(t, out, "NICK senpai")
+	handle(t, s, ":irc.example.org 432 senpai_ senpai :Erroneous nickname")
+	s.RegainNick()
+	assertSent(t, out)
+}
+
+func TestWhois(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{Nickname: "senpai"})
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	drain(out)
+
+	s.Whois("kouhai")
+	assertSent(t, out, "WHOIS kouhai")
+
+	for _, line := range []string{
+		":irc.example.org 311 senpai kouhai ~kouhai example.org * :Kouhai Kun",
+		":irc.example.org 319 senpai kouhai :@#senpai +#test",
+		":irc.example.org 319 senpai kouhai :#more",
+		":irc.example.org 312 senpai kouhai irc.example.org :Example server",
+		":irc.example.org 301 senpai kouhai :gone fishing",
+		":irc.example.org 313 senpai kouhai :is an IRC operator",
+		":irc.example.org 671 senpai kouhai :is using a secure connection",
+		":irc.example.org 378 senpai kouhai :is connecting from *@example.org 192.0.2.1",
+		":irc.example.org 317 senpai kouhai 42 1630454400 :seconds idle, signon time",
+		":irc.example.org 330 senpai kouhai kouhai_acct :is logged in as",
+	} {
+		if ev := handle(t, s, line); ev != nil {
+			t.Errorf("%q: expected no event, got %#v", line, ev)
+		}
+	}
+
+	ev := handle(t, s, ":irc.example.org 318 senpai kouhai :End of /WHOIS list.")
+	w, ok := ev.(WhoisEvent)
+	if !ok {
+		t.Fatalf("expected a WhoisEvent, got %#v", ev)
+	}
+	expected := WhoisEvent{
+		Nick:       "kouhai",
+		User:       "~kouhai",
+		Host:       "example.org",
+		RealName:   "Kouhai Kun",
+		Server:     "irc.example.org",
+		ServerInfo: "Example server",
+		Account:    "kouhai_acct",
+		Channels:   []string{"@#senpai", "+#test", "#more"},
+		Idle:       42 * time.Second,
+		Signon:     time.Unix(1630454400, 0),
+		Away:       "gone fishing",
+		Secure:     true,
+		Operator:   true,
+		Info:       []string{"is connecting from *@example.org 192.0.2.1"},
+	}
+	if !reflect.DeepEqual(w, expected) {
+		t.Errorf("expected %+v, got %+v", expected, w)
+	}
+
+	// Unknown users only get an error.
+	ev = handle(t, s, ":irc.example.org 401 senpai nobody :No such nick/channel")
+	if _, ok := ev.(ErrorEvent); !ok {
+		t.Errorf("expected an ErrorEvent, got %#v", ev)
+	}
+	if ev := handle(t, s, ":irc.example.org 318 senpai nobody :End of /WHOIS list."); ev != nil {
+		t.Errorf("expected no event, got %#v", ev)
+	}
+}
+
+func TestAway(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{Nickname: "senpai"})
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	drain(out)
+
+	s.SetAway("gone")
+	assertSent(t, out, "AWAY gone")
+	ev := handle(t, s, ":irc.example.org 306 senpai :You have been marked as being away")
+	if ev, ok := ev.(SelfAwayEvent); !ok || !ev.Away {
+		t.Errorf("expected a SelfAwayEvent, got %#v", ev)
+	}
+	if !s.IsAway() {
+		t.Error("expected to be away")
+	}
+
+	s.SetAway("")
+	assertSent(t, out, "AWAY")
+	ev = handle(t, s, ":irc.example.org 305 senpai :You are no longer marked as being away")
+	if ev, ok := ev.(SelfAwayEvent); !ok || ev.Away {
+		t.Errorf("expected a SelfAwayEvent, got %#v", ev)
+	}
+	if s.IsAway() {
+		t.Error("expected to be back")
+	}
+}
+
+func TestUserAway(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{Nickname: "senpai"})
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	drain(out)
+
+	ev := handle(t, s, ":irc.example.org 301 senpai kouhai :gone fishing")
+	if ev, ok := ev.(UserAwayEvent); !ok || ev.User != "kouhai" || ev.Message != "gone fishing" {
+		t.Errorf("expected a UserAwayEvent, got %#v", ev)
+	}
+	// The same message is only reported once.
+	if ev := handle(t, s, ":irc.example.org 301 senpai kouhai :gone fishing"); ev != nil {
+		t.Errorf("expected no event, got %#v", ev)
+	}
+	if ev := handle(t, s, ":irc.example.org 301 senpai Kouhai :back soon"); ev == nil {
+		t.Error("expected a new away message to be reported")
+	}
+
+	// Until the user comes back.
+	handle(t, s, ":kouhai!kouhai@example.org AWAY")
+	if ev := handle(t, s, ":irc.example.org 301 senpai kouhai :back soon"); ev == nil {
+		t.Error("expected the away message to be reported again")
+	}
+}
+
+// newAccountSession returns a registered session in #senpai, with the account
+// capabilities enabled.
+func newAccountSession(t *testing.T) (*Session, chan Message) {
+	s, out := newTestSession(t, SessionParams{Nickname: "senpai"})
+	handle(t, s, ":irc.example.org CAP * ACK :account-notify account-tag extended-join")
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	handle(t, s, ":senpai!senpai@example.org JOIN #senpai senpai :Senpai")
+	handle(t, s, ":irc.example.org 353 senpai = #senpai :senpai")
+	handle(t, s, ":irc.example.org 366 senpai #senpai :End of /NAMES list")
+	drain(out)
+	return s, out
+}
+
+func TestAccountTracking(t *testing.T) {
+	s, _ := newAccountSession(t)
+
+	account := func(nick string) string {
+		for _, m := range s.Names("#senpai") {
+			if m.Name.Name == nick {
+				return m.Account
+			}
+		}
+		t.Fatalf("%s is not in #senpai", nick)
+		return ""
+	}
+
+	handle(t, s, ":kouhai!kouhai@example.org JOIN #senpai kouhai_acct :Kouhai Kun")
+	if a := account("kouhai"); a != "kouhai_acct" {
+		t.Errorf("expected kouhai to be logged in as kouhai_acct, got %q", a)
+	}
+	if real := s.users["kouhai"].RealName; real != "Kouhai Kun" {
+		t.Errorf("expected the realname of kouhai to be set, got %q", real)
+	}
+	handle(t, s, ":sensei!sensei@example.org JOIN #senpai * :Sensei")
+	if a := account("sensei"); a != "" {
+		t.Errorf("expected sensei not to be logged in, got %q", a)
+	}
+
+	handle(t, s, ":sensei!sensei@example.org ACCOUNT sensei_acct")
+	if a := account("sensei"); a != "sensei_acct" {
+		t.Errorf("expected sensei to be logged in as sensei_acct, got %q", a)
+	}
+	handle(t, s, ":kouhai!kouhai@example.org ACCOUNT *")
+	if a := account("kouhai"); a != "" {
+		t.Errorf("expected kouhai to be logged out, got %q", a)
+	}
+}
+
+func TestAccountTag(t *testing.T) {
+	s, _ := newAccountSession(t)
+
+	ev := handle(t, s, "@account=kouhai_acct :kouhai!kouhai@example.org PRIVMSG #senpai :hi")
+	if ev, ok := ev.(MessageEvent); !ok || ev.Account != "kouhai_acct" || ev.Unidentified {
+		t.Errorf("expected a message from kouhai_acct, got %#v", ev)
+	}
+
+	// Someone else takes the nick.
+	handle(t, s, ":kouhai!kouhai@example.org QUIT :bye")
+	ev = handle(t, s, ":kouhai!evil@example.net PRIVMSG senpai :hi, it's me")
+	if ev, ok := ev.(MessageEvent); !ok || ev.Account != "" || !ev.Unidentified {
+		t.Errorf("expected a message from an unidentified user, got %#v", ev)
+	}
+	ev = handle(t, s, "@account=evil :kouhai!evil@example.net PRIVMSG senpai :hi, it's me")
+	if ev, ok := ev.(MessageEvent); !ok || !ev.Unidentified {
+		t.Errorf("expected a message from an unidentified user, got %#v", ev)
+	}
+
+	// Users that have never been seen logged in are not suspicious.
+	ev = handle(t, s, ":sensei!sensei@example.org PRIVMSG senpai :hello")
+	if ev, ok := ev.(MessageEvent); !ok || ev.Unidentified {
+		t.Errorf("expected a message from an anonymous user, got %#v", ev)
+	}
+}
+
+func TestAccountWithoutTag(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{Nickname: "senpai"})
+	handle(t, s, ":irc.example.org CAP * ACK :account-notify extended-join")
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	handle(t, s, ":senpai!senpai@example.org JOIN #senpai senpai :Senpai")
+	drain(out)
+
+	handle(t, s, ":kouhai!kouhai@example.org JOIN #senpai kouhai_acct :Kouhai")
+	ev := handle(t, s, ":kouhai!kouhai@example.org PRIVMSG #senpai :hi")
+	if ev, ok := ev.(MessageEvent); !ok || ev.Account != "kouhai_acct" || ev.Unidentified {
+		t.Errorf("expected a message from kouhai_acct, got %#v", ev)
+	}
+
+	// Someone else takes the nick.
+	handle(t, s, ":kouhai!kouhai@example.org QUIT :bye")
+	handle(t, s, ":kouhai!evil@example.net JOIN #senpai * :Kouhai")
+	ev = handle(t, s, ":kouhai!evil@example.net PRIVMSG #senpai :hi, it's me")
+	if ev, ok := ev.(MessageEvent); !ok || ev.Account != "" || !ev.Unidentified {
+		t.Errorf("expected a message from an unidentified user, got %#v", ev)
+	}
+}
+
+func TestChghost(t *testing.T) {
+	if _, ok := requestedCaps(t)["chghost"]; !ok {
+		t.Errorf("expected chghost to be requested")
+	}
+	s0, _ := newTestSession(t, SessionParams{Nickname: "senpai"})
+	handle(t, s0, ":irc.example.org CAP * LS :chghost")
+	handle(t, s0, ":irc.example.org CAP * ACK chghost")
+	if !s0.HasCapability("chghost") {
+		t.Errorf("expected chghost to be enabled once acknowledged")
+	}
+
+	s, _ := newAccountSession(t)
+	handle(t, s, ":kouhai!kouhai@example.org JOIN #senpai * :Kouhai")
+
+	ev := handle(t, s, ":kouhai!kouhai@example.org CHGHOST ~kouhai kouhai.example.org")
+	expected := UserHostEvent{
+		User:       "kouhai",
+		FormerHost: "kouhai@example.org",
+		Host:       "~kouhai@kouhai.example.org",
+	}
+	if ev, ok := ev.(UserHostEvent); !ok || ev.User != expected.User || ev.FormerHost != expected.FormerHost || ev.Host != expected.Host {
+		t.Errorf("expected %#v, got %#v", expected, ev)
+	}
+	if name := s.users["kouhai"].Name; name.User != "~kouhai" || name.Host != "kouhai.example.org" {
+		t.Errorf("expected the host of kouhai to be updated, got %q", name.String())
+	}
+
+	handle(t, s, ":senpai!senpai@example.org CHGHOST senpai senpai.example.org")
+	if s.host != "senpai.example.org" {
+		t.Errorf("expected our host to be updated, got %q", s.host)
+	}
+}
+
+func TestSetname(t *testing.T) {
+	s, out := newAccountSession(t)
+	handle(t, s, ":kouhai!kouhai@example.org JOIN #senpai * :Kouhai")
+
+	if err := s.SetRealName("Senpai Sama"); err == nil {
+		t.Error("expected SETNAME to be refused without the capability")
+	}
+	handle(t, s, ":irc.example.org CAP senpai ACK setname")
+	if err := s.SetRealName("Senpai Sama"); err != nil {
+		t.Fatal(err)
+	}
+	assertSent(t, out, "SETNAME :Senpai Sama")
+
+	ev := handle(t, s, ":kouhai!kouhai@example.org SETNAME :Kouhai Kun")
+	if ev, ok := ev.(UserRealNameEvent); !ok || ev.FormerRealName != "Kouhai" || ev.RealName != "Kouhai Kun" {
+		t.Errorf("expected a UserRealNameEvent, got %#v", ev)
+	}
+	if real := s.users["kouhai"].RealName; real != "Kouhai Kun" {
+		t.Errorf("expected the realname of kouhai to be updated, got %q", real)
+	}
+}
+
+func TestMsgid(t *testing.T) {
+	s, _ := newAccountSession(t)
+
+	ev := handle(t, s, "@msgid=abc :kouhai!kouhai@example.org PRIVMSG #senpai :hi")
+	if ev, ok := ev.(MessageEvent); !ok || ev.ID != "abc" {
+		t.Errorf("expected a message with an ID, got %#v", ev)
+	}
+	ev = handle(t, s, "@msgid=def :kouhai!kouhai@example.org JOIN #senpai")
+	if ev, ok := ev.(UserJoinEvent); !ok || ev.ID != "def" {
+		t.Errorf("expected a join with an ID, got %#v", ev)
+	}
+	ev = handle(t, s, ":kouhai!kouhai@example.org PRIVMSG #senpai :hi")
+	if ev, ok := ev.(MessageEvent); !ok || ev.ID != "" {
+		t.Errorf("expected a message without ID, got %#v", ev)
+	}
+}
+
+func TestReplyAndReact(t *testing.T) {
+	s, out := newAccountSession(t)
+	handle(t, s, ":irc.example.org CAP * ACK message-tags")
+
+	ev := handle(t, s, "@msgid=b;+draft/reply=a :kouhai!kouhai@example.org PRIVMSG #senpai :yes")
+	if ev, ok := ev.(MessageEvent); !ok || ev.ReplyTo != "a" {
+		t.Errorf("expected a reply to a, got %#v", ev)
+	}
+
+	ev = handle(t, s, "@+draft/react=👍 :kouhai!kouhai@example.org TAGMSG #senpai")
+	if ev != nil {
+		t.Errorf("expected nothing from a reaction to no message, got %#v", ev)
+	}
+	ev = handle(t, s, "@+draft/reply=a;+draft/react=👍 :kouhai!kouhai@example.org TAGMSG #senpai")
+	expected := ReactionEvent{
+		User:            "kouhai",
+		Target:          "#senpai",
+		TargetIsChannel: true,
+		ReplyTo:         "a",
+		Reaction:        "👍",
+	}
+	r, ok := ev.(ReactionEvent)
+	r.Time = time.Time{}
+	if !ok || r != expected {
+		t.Errorf("expected %#v, got %#v", expected, ev)
+	}
+
+	s.Reply("#senpai", "b", "indeed")
+	if err := s.React("#senpai", "b", "👀"); err != nil {
+		t.Fatal(err)
+	}
+	assertSent(t, out,
+		"@+draft/reply=b PRIVMSG #senpai indeed",
+		"@+draft/react=👀;+draft/reply=b TAGMSG #senpai")
+}
+
+func TestRedact(t *testing.T) {
+	if _, ok := requestedCaps(t)["draft/message-redaction"]; !ok {
+		t.Errorf("expected draft/message-redaction to be requested")
+	}
+
+	s, out := newAccountSession(t)
+
+	if err := s.Redact("#senpai", "a", ""); err == nil {
+		t.Errorf("expected an error when the server does not support redaction")
+	}
+	handle(t, s, ":irc.example.org CAP * ACK draft/message-redaction")
+
+	ev := handle(t, s, ":kouhai!kouhai@example.org REDACT #senpai a :oops")
+	expected := RedactEvent{
+		User:            "kouhai",
+		Target:          "#senpai",
+		TargetIsChannel: true,
+		Redacted:        "a",
+		Reason:          "oops",
+	}
+	r, ok := ev.(RedactEvent)
+	r.Time = time.Time{}
+	if !ok || r != expected {
+		t.Errorf("expected %#v, got %#v", expected, ev)
+	}
+
+	if err := s.Redact("#senpai", "b", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Redact("#senpai", "c", "typo"); err != nil {
+		t.Fatal(err)
+	}
+	assertSent(t, out, "REDACT #senpai b", "REDACT #senpai c typo")
+}
+
+func TestCTCP(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{
+		Nickname:    "senpai",
+		CTCPReplies: CTCPReplies{"VERSION": "senpai", "PING": "", "CLIENTINFO": ""},
+	})
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	drain(out)
+
+	ev := handle(t, s, ":kouhai!kouhai@example.org PRIVMSG senpai :\x01VERSION\x01")
+	if ev, ok := ev.(CTCPEvent); !ok || ev.Command != "VERSION" || !ev.Replied {
+		t.Errorf("expected an answered VERSION request, got %#v", ev)
+	}
+	handle(t, s, ":kouhai!kouhai@example.org PRIVMSG senpai :\x01ping 123 456\x01")
+	handle(t, s, ":kouhai!kouhai@example.org PRIVMSG senpai :\x01CLIENTINFO\x01")
+	assertSent(t, out,
+		"NOTICE kouhai :\x01VERSION senpai\x01",
+		"NOTICE kouhai :\x01PING 123 456\x01",
+		"NOTICE kouhai :\x01CLIENTINFO ACTION CLIENTINFO PING VERSION\x01")
+
+	// Unknown requests and requests past the rate limit are not answered.
+	ev = handle(t, s, ":kouhai!kouhai@example.org PRIVMSG senpai :\x01TIME\x01")
+	if ev, ok := ev.(CTCPEvent); !ok || ev.Replied {
+		t.Errorf("expected an unanswered TIME request, got %#v", ev)
+	}
+	ev = handle(t, s, ":kouhai!kouhai@example.org PRIVMSG senpai :\x01VERSION\x01")
+	if ev, ok := ev.(CTCPEvent); !ok || ev.Replied {
+		t.Errorf("expected the rate limit to apply, got %#v", ev)
+	}
+	assertSent(t, out)
+
+	ev = handle(t, s, ":kouhai!kouhai@example.org PRIVMSG senpai :\x01ACTION waves\x01")
+	if _, ok := ev.(MessageEvent); !ok {
+		t.Errorf("expected actions to be messages, got %#v", ev)
+	}
+	ev = handle(t, s, ":kouhai!kouhai@example.org NOTICE senpai :\x01VERSION HexChat 2.16\x01")
+	expected := CTCPReplyEvent{User: "kouhai", Command: "VERSION", Params: "HexChat 2.16"}
+	r, ok := ev.(CTCPReplyEvent)
+	r.Time = time.Time{}
+	if !ok || r != expected {
+		t.Errorf("expected %#v, got %#v", expected, ev)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{Nickname: "senpai"})
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	drain(out)
+
+	// Nicks are sent once the server tells it supports MONITOR.
+	if err := s.Monitor("kouhai", "sensei"); err != nil {
+		t.Fatal(err)
+	}
+	assertSent(t, out)
+	handle(t, s, ":irc.example.org 005 senpai MONITOR=3 :are supported")
+	assertSent(t, out, "MONITOR + kouhai,sensei")
+
+	ev := handle(t, s, ":irc.example.org 730 senpai :kouhai!kouhai@example.org")
+	if ev, ok := ev.(MonitorEvent); !ok || !ev.Online || !reflect.DeepEqual(ev.Users, []string{"kouhai"}) {
+		t.Errorf("expected kouhai to be online, got %#v", ev)
+	}
+	// Users that are offline from the start are not worth telling about.
+	if ev := handle(t, s, ":irc.example.org 731 senpai :sensei"); ev != nil {
+		t.Errorf("expected nothing, got %#v", ev)
+	}
+	ev = handle(t, s, ":irc.example.org 731 senpai :kouhai,sensei")
+	if ev, ok := ev.(MonitorEvent); !ok || ev.Online || !reflect.DeepEqual(ev.Users, []string{"kouhai"}) {
+		t.Errorf("expected kouhai to be offline, got %#v", ev)
+	}
+
+	if err := s.Monitor("Kouhai", "senpai2", "senpai3"); err == nil {
+		t.Errorf("expected an error past the MONITOR limit")
+	}
+	s.Unmonitor("sensei", "nobody")
+	assertSent(t, out, "MONITOR + senpai2", "MONITOR - sensei")
+
+	expected := []MonitorEntry{
+		{Nick: "kouhai", Known: true},
+		{Nick: "senpai2"},
+	}
+	if entries := s.Monitored(); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected %#v, got %#v", expected, entries)
+	}
+
+	ev = handle(t, s, ":irc.example.org 734 senpai 3 senpai2 :Monitor list is full")
+	if _, ok := ev.(ErrorEvent); !ok || len(s.Monitored()) != 1 {
+		t.Errorf("expected an error and senpai2 to be removed, got %#v and %#v", ev, s.Monitored())
+	}
+}
+
+func TestWhox(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{Nickname: "senpai"})
+	handle(t, s, ":irc.example.org CAP * ACK account-notify")
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	handle(t, s, ":irc.example.org 005 senpai WHOX :are supported")
+	handle(t, s, ":senpai!senpai@example.org JOIN #senpai")
+	handle(t, s, ":irc.example.org 353 senpai = #senpai :senpai @kouhai sensei")
+	drain(out)
+	if _, ok := handle(t, s, ":irc.example.org 366 senpai #senpai :End of /NAMES list").(SelfJoinEvent); !ok {
+		t.Fatalf("expected to have joined #senpai")
+	}
+	assertSent(t, out, "MODE #senpai", "WHO #senpai %tcuhnfar,771")
+
+	handle(t, s, ":irc.example.org 354 senpai 771 #senpai ~k kouhai.example.org kouhai G@ kouhai :Kou Hai")
+	handle(t, s, ":irc.example.org 354 senpai 771 #senpai sensei 192.0.2.1 sensei H 0 :Sensei")
+	handle(t, s, ":irc.example.org 354 senpai 42 #senpai x x sensei G x :x")
+	handle(t, s, ":irc.example.org 315 senpai #senpai :End of WHO list")
+
+	expected := []Member{
+		{
+			PowerLevel: "@",
+			Name:       &Prefix{Name: "kouhai", User: "~k", Host: "kouhai.example.org"},
+			Away:       true,
+			Account:    "kouhai",
+		},
+		{Name: &Prefix{Name: "senpai"}},
+		{Name: &Prefix{Name: "sensei", User: "sensei", Host: "192.0.2.1"}},
+	}
+	if names := s.Names("#senpai"); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %#v, got %#v", expected, names)
+	}
+}
+
+func TestWhoFallback(t *testing.T) {
+	s, out := newTestSession(t, SessionParams{Nickname: "senpai"})
+	handle(t, s, ":irc.example.org CAP * ACK away-notify")
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	handle(t, s, ":senpai!senpai@example.org JOIN #senpai")
+	handle(t, s, ":irc.example.org 353 senpai = #senpai :senpai kouhai")
+	drain(out)
+	handle(t, s, ":irc.example.org 366 senpai #senpai :End of /NAMES list")
+	assertSent(t, out, "MODE #senpai", "WHO #senpai")
+
+	handle(t, s, ":irc.example.org 352 senpai #senpai ~k kouhai.example.org irc.example.org kouhai G :0 Kou Hai")
+	u := s.users["kouhai"]
+	if !u.Away || u.Name.Host != "kouhai.example.org" || u.RealName != "Kou Hai" {
+		t.Errorf("expected kouhai to be updated, got %#v with %#v", u, u.Name)
+	}
+}
+
+func TestKick(t *testing.T) {
+	s, _ := newAccountSession(t)
+	handle(t, s, ":kouhai!kouhai@example.org JOIN #senpai kouhai :Kouhai")
+
+	ev := handle(t, s, ":sensei!sensei@example.org KICK #senpai kouhai :behave")
+	expected := UserKickEvent{User: "kouhai", Kicker: "sensei", Channel: "#senpai", Comment: "behave"}
+	k, ok := ev.(UserKickEvent)
+	k.Time = time.Time{}
+	if !ok || k != expected {
+		t.Errorf("expected %#v, got %#v", expected, ev)
+	}
+
+	ev = handle(t, s, ":sensei!sensei@example.org KICK #senpai senpai")
+	if ev, ok := ev.(SelfKickEvent); !ok || ev.Kicker != "sensei" || ev.Channel != "#senpai" || ev.Comment != "" {
+		t.Errorf("expected to be kicked by sensei, got %#v", ev)
+	}
+	if s.IsJoined("#senpai") {
+		t.Errorf("expected #senpai to be left")
+	}
+}
+
+func TestPartQuitReasons(t *testing.T) {
+	s, _ := newAccountSession(t)
+	handle(t, s, ":kouhai!kouhai@example.org JOIN #senpai kouhai :Kouhai")
+	handle(t, s, ":sensei!sensei@example.org JOIN #senpai sensei :Sensei")
+
+	ev := handle(t, s, ":kouhai!kouhai@example.org PART #senpai :see you")
+	if ev, ok := ev.(UserPartEvent); !ok || ev.Reason != "see you" {
+		t.Errorf("expected a part with a reason, got %#v", ev)
+	}
+	ev = handle(t, s, ":sensei!sensei@example.org QUIT :Quit: bye")
+	if ev, ok := ev.(UserQuitEvent); !ok || ev.Reason != "Quit: bye" {
+		t.Errorf("expected a quit with a reason, got %#v", ev)
+	}
+}
+
+func TestChannelModes(t *testing.T) {
+	s, _ := newAccountSession(t)
+	handle(t, s, ":irc.example.org 005 senpai CHANMODES=beI,k,l,imnst PREFIX=(ov)@+ :are supported")
+	handle(t, s, ":kouhai!kouhai@example.org JOIN #senpai kouhai :Kouhai")
+
+	ev := handle(t, s, ":irc.example.org 324 senpai #senpai +ntl 50")
+	if _, ok := ev.(ChannelModesEvent); !ok {
+		t.Errorf("expected a ChannelModesEvent, got %#v", ev)
+	}
+	handle(t, s, ":irc.example.org 329 senpai #senpai 1600000000")
+	if modes := s.ChannelModes("#senpai"); modes != "+lnt 50" {
+		t.Errorf("expected +lnt 50, got %q", modes)
+	}
+
+	ev = handle(t, s, ":sensei!sensei@example.org MODE #senpai +kob-l hunter2 kouhai *!*@example.org")
+	expected := []ModeChange{
+		{Enable: true, Mode: 'k', Param: "hunter2"},
+		{Enable: true, Mode: 'o', Param: "kouhai", Membership: true},
+		{Enable: true, Mode: 'b', Param: "*!*@example.org"},
+		{Enable: false, Mode: 'l'},
+	}
+	if ev, ok := ev.(ModeChangeEvent); !ok || ev.User != "sensei" || !reflect.DeepEqual(ev.Changes, expected) {
+		t.Errorf("expected %#v from sensei, got %#v", expected, ev)
+	}
+
+	c := s.channels["#senpai"]
+	if c.Key != "hunter2" || c.Limit != 0 || c.Created.Unix() != 1600000000 {
+		t.Errorf("expected the key to be set and the limit removed, got %#v", c)
+	}
+	if modes := s.ChannelModes("#senpai"); modes != "+knt" {
+		t.Errorf("expected +knt, got %q", modes)
+	}
+}
+
+func TestModeLists(t *testing.T) {
+	s, out := newAccountSession(t)
+	handle(t, s, ":irc.example.org 005 senpai MODES=2 :are supported")
+
+	s.RequestModeList("#senpai", 'b')
+	assertSent(t, out, "MODE #senpai +b")
+	handle(t, s, ":irc.example.org 367 senpai #senpai *!*@bad.example.org sensei 1600000000")
+	handle(t, s, ":irc.example.org 367 senpai #senpai *!troll@*")
+	ev := handle(t, s, ":irc.example.org 368 senpai #senpai :End of channel ban list")
+	expected := ModeListEvent{
+		Channel: "#senpai",
+		Mode:    'b',
+		Entries: []ListEntry{
+			{Mask: "*!*@bad.example.org", SetBy: "sensei", SetAt: time.Unix(1600000000, 0)},
+			{Mask: "*!troll@*"},
+		},
+	}
+	if !reflect.DeepEqual(ev, expected) {
+		t.Errorf("expected %#v, got %#v", expected, ev)
+	}
+
+	ev = handle(t, s, ":irc.example.org 349 senpai #senpai :End of channel exception list")
+	if ev, ok := ev.(ModeListEvent); !ok || ev.Mode != 'e' || len(ev.Entries) != 0 {
+		t.Errorf("expected an empty exception list, got %#v", ev)
+	}
+
+	s.ChangeModes("#senpai", []ModeChange{
+		{Enable: false, Mode: 'b', Param: "a!*@*"},
+		{Enable: false, Mode: 'b', Param: "b!*@*"},
+		{Enable: true, Mode: 'm'},
+		{Enable: false, Mode: 'b', Param: "c!*@*"},
+	})
+	assertSent(t, out, "MODE #senpai -bb+m a!*@* b!*@*", "MODE #senpai -b c!*@*")
+}
+
+func TestList(t *testing.T) {
+	s, out := newAccountSession(t)
+	handle(t, s, ":irc.example.org 005 senpai ELIST=mu :are supported")
+	if !s.HasListCondition('U') || s.HasListCondition('C') {
+		t.Errorf("expected only the M and U conditions to be supported")
+	}
+
+	s.List(">10", "*senpai*")
+	assertSent(t, out, "LIST >10,*senpai*")
+	handle(t, s, ":irc.example.org 321 senpai Channel :Users  Name")
+	handle(t, s, ":irc.example.org 322 senpai #senpai 42 :[+nt] the senpai channel")
+	handle(t, s, ":irc.example.org 322 senpai #senpai-dev 12 :")
+	ev := handle(t, s, ":irc.example.org 323 senpai :End of /LIST")
+	expected := ChannelListEvent{
+		Channels: []ListedChannel{
+			{Name: "#senpai", Users: 42, Topic: "[+nt] the senpai channel"},
+			{Name: "#senpai-dev", Users: 12},
+		},
+		Done: true,
+	}
+	if !reflect.DeepEqual(ev, expected) {
+		t.Errorf("expected %#v, got %#v", expected, ev)
+	}
+}
@@ -3,6 +3,8 @@ package irc
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -282,7 +284,7 @@ func (msg Message) WithTag(key, value string) Message {
 	if msg.Tags == nil {
 		msg.Tags = map[string]string{}
 	}
-	msg.Tags[key] = escapeTagValue(value)
+	msg.Tags[key] = value
 	return msg
 }
 
@@ -305,14 +307,21 @@ func (msg *Message) String() string {
 	var sb strings.Builder
 
 	if msg.Tags != nil {
+		keys := make([]string, 0, len(msg.Tags))
+		for k := range msg.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
 		sb.WriteRune('@')
-		for k, v := range msg.Tags {
+		for i, k := range keys {
+			if i != 0 {
+				sb.WriteRune(';')
+			}
 			sb.WriteString(k)
-			if v != "" {
+			if v := msg.Tags[k]; v != "" {
 				sb.WriteRune('=')
 				sb.WriteString(escapeTagValue(v))
 			}
-			sb.WriteRune(';')
 		}
 		sb.WriteRune(' ')
 	}
@@ -458,11 +467,52 @@ func ParseCaps(caps string) (diff []Cap) {
 	return
 }
 
+// STSPolicy is the value of the "sts" capability.
+//
+// ref: https://ircv3.net/specs/extensions/sts
+type STSPolicy struct {
+	Port        int           // port to connect to with TLS, or 0 if absent.
+	Duration    time.Duration // how long the policy must be remembered.
+	HasDuration bool          // whether Duration has been given.
+	Preload     bool
+}
+
+// ParseSTSPolicy parses the value of the "sts" capability.
+func ParseSTSPolicy(value string) (policy STSPolicy, err error) {
+	for _, kv := range strings.Split(value, ",") {
+		kv := strings.SplitN(kv, "=", 2)
+		switch strings.ToLower(kv[0]) {
+		case "port":
+			if len(kv) < 2 {
+				return policy, errors.New("missing sts port")
+			}
+			policy.Port, err = strconv.Atoi(kv[1])
+			if err != nil || policy.Port <= 0 || 65535 < policy.Port {
+				return policy, fmt.Errorf("invalid sts port %q", kv[1])
+			}
+		case "duration":
+			if len(kv) < 2 {
+				return policy, errors.New("missing sts duration")
+			}
+			seconds, err := strconv.ParseUint(kv[1], 10, 32)
+			if err != nil {
+				return policy, fmt.Errorf("invalid sts duration %q", kv[1])
+			}
+			policy.Duration = time.Duration(seconds) * time.Second
+			policy.HasDuration = true
+		case "preload":
+			policy.Preload = true
+		}
+	}
+	return policy, nil
+}
+
 // Member is a token in RPL_NAMREPLY's last parameter.
 type Member struct {
 	PowerLevel string
 	Name       *Prefix
 	Away       bool
+	Account    string // "" if not logged in or unknown.
 }
 
 type members []Member
@@ -512,9 +562,10 @@ const (
 )
 
 type ModeChange struct {
-	Enable bool
-	Mode   byte
-	Param  string
+	Enable     bool
+	Mode       byte
+	Param      string
+	Membership bool // whether Mode is in PREFIX, such as 'o' for operators.
 }
 
 // ParseChannelMode parses a MODE message for a channel, according to the
@@ -536,7 +587,8 @@ func ParseChannelMode(mode string, params []string, chanmodes [4]string, members
 				break
 			}
 		}
-		if 0 <= strings.IndexByte(membershipModes, m) {
+		membership := 0 <= strings.IndexByte(membershipModes, m)
+		if membership {
 			modeType = ModeTypeB
 		} else if modeType == -1 {
 			return nil, fmt.Errorf("unknown mode %c", m)
@@ -547,9 +599,10 @@ func ParseChannelMode(mode string, params []string, chanmodes [4]string, members
 				return nil, fmt.Errorf("missing mode params")
 			}
 			changes = append(changes, ModeChange{
-				Enable: enable,
-				Mode:   m,
-				Param:  params[paramIdx],
+				Enable:     enable,
+				Mode:       m,
+				Param:      params[paramIdx],
+				Membership: membership,
 			})
 			paramIdx++
 		} else {
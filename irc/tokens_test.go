@@ -0,0 +1,24 @@
+package irc
+
+import "testing"
+
+func TestMessageTags(t *testing.T) {
+	msg := NewMessage("TAGMSG", "#senpai").
+		WithTag("+draft/reply", "a;b c\\d").
+		WithTag("+draft/react", "👀").
+		WithTag("+typing", "")
+
+	// Tags are sorted, and their values escaped once.
+	expected := `@+draft/react=👀;+draft/reply=a\:b\sc\\d;+typing TAGMSG #senpai`
+	if s := msg.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+
+	parsed, err := ParseMessage(msg.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := parsed.Tags["+draft/reply"]; v != "a;b c\\d" {
+		t.Errorf("expected the tag value to survive a round trip, got %q", v)
+	}
+}
@@ -0,0 +1,297 @@
+package irc
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// WebSocket subprotocols of the IRCv3 WebSocket transport.  IRC messages are
+// sent one per frame, without the trailing "\r\n".  Text frames must be valid
+// UTF-8 while binary frames can contain anything.
+//
+// ref: https://ircv3.net/specs/extensions/websocket
+const (
+	WebsocketBinary = "binary.ircv3.net"
+	WebsocketText   = "text.ircv3.net"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes.
+//
+// ref: https://datatracker.ietf.org/doc/html/rfc6455#section-5.2
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// websocketMaxMessage is the maximum length of a message read from the server,
+// far above what IRC allows (8191 bytes of tags and 512 bytes for the rest).
+const websocketMaxMessage = 16384
+
+// WebsocketConn is a client WebSocket connection, established with
+// WebsocketHandshake.  Use WebsocketInOut to exchange IRC messages over it.
+type WebsocketConn struct {
+	net.Conn
+
+	r        *bufio.Reader
+	protocol string
+
+	wlock sync.Mutex // frames are also written by the reader to answer pings.
+}
+
+// WebsocketHandshake sends the WebSocket opening handshake for the IRC
+// subprotocols over conn, to the given ws:// or wss:// URL.  TLS, if needed,
+// must already be established on conn.
+func WebsocketHandshake(conn net.Conn, u *url.URL) (*WebsocketConn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", WebsocketBinary+", "+WebsocketText)
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket handshake failed: %s", res.Status)
+	}
+	if !strings.EqualFold(res.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("websocket handshake failed: missing upgrade")
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	if res.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, errors.New("websocket handshake failed: invalid Sec-WebSocket-Accept")
+	}
+
+	protocol := res.Header.Get("Sec-WebSocket-Protocol")
+	switch protocol {
+	case WebsocketBinary, WebsocketText:
+	case "":
+		// Servers default to text frames when no subprotocol is
+		// negotiated.
+		protocol = WebsocketText
+	default:
+		return nil, fmt.Errorf("websocket handshake failed: unsupported subprotocol %q", protocol)
+	}
+
+	return &WebsocketConn{
+		Conn:     conn,
+		r:        r,
+		protocol: protocol,
+	}, nil
+}
+
+// Protocol returns the negotiated subprotocol, either WebsocketBinary or
+// WebsocketText.
+func (ws *WebsocketConn) Protocol() string {
+	return ws.protocol
+}
+
+// WebsocketInOut is the counterpart of ChanInOut for WebSocket connections.
+func WebsocketInOut(ws *WebsocketConn, fc FloodControl) (in <-chan Message, out chan<- Message, sent <-chan struct{}) {
+	in_ := make(chan Message, chanCapacity)
+	out_ := make(chan Message, chanCapacity)
+	sent_ := make(chan struct{})
+	welcome := make(chan struct{})
+
+	go func() {
+		w := welcome
+		for {
+			payload, err := ws.readMessage()
+			if err != nil {
+				break
+			}
+			msg, err := ParseMessage(strings.TrimRight(string(payload), "\r\n"))
+			if err != nil {
+				continue
+			}
+			w = notifyWelcome(msg, w)
+			in_ <- msg
+		}
+		close(in_)
+	}()
+
+	go func() {
+		opcode := byte(wsBinary)
+		if ws.protocol == WebsocketText {
+			opcode = wsText
+		}
+		sendLoop(out_, fc, realClock{}, welcome, func(lines []string) error {
+			payloads := make([][]byte, len(lines))
+			for i, line := range lines {
+				if opcode == wsText {
+					line = strings.ToValidUTF8(line, "\uFFFD")
+				}
+				payloads[i] = []byte(line)
+			}
+			return ws.writeFrames(opcode, payloads...)
+		})
+		_ = ws.writeFrames(wsClose, []byte{0x03, 0xe8}) // 1000: normal closure
+		_ = ws.Close()
+		close(sent_)
+	}()
+
+	return in_, out_, sent_
+}
+
+// readMessage returns the payload of the next data message, reassembling
+// fragments and answering control frames along the way.
+func (ws *WebsocketConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := readWebsocketFrame(ws.r)
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err := ws.writeFrames(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			_ = ws.writeFrames(wsClose, payload)
+			return nil, io.EOF
+		case wsText, wsBinary, wsContinuation:
+		default:
+			return nil, fmt.Errorf("unknown websocket opcode %d", opcode)
+		}
+		message = append(message, payload...)
+		if len(message) > websocketMaxMessage {
+			return nil, errors.New("websocket message too long")
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// writeFrames writes one frame per payload, at once.
+func (ws *WebsocketConn) writeFrames(opcode byte, payloads ...[]byte) error {
+	ws.wlock.Lock()
+	defer ws.wlock.Unlock()
+
+	var buf []byte
+	for _, payload := range payloads {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, websocketFrame(opcode, payload, mask[:])...)
+	}
+	_, err := ws.Conn.Write(buf)
+	return err
+}
+
+// websocketFrame encodes a single, final frame.  The payload is masked if mask
+// is not nil, as required for frames sent by clients.
+func websocketFrame(opcode byte, payload []byte, mask []byte) []byte {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if mask != nil {
+		maskBit = 0x80
+	}
+	switch l := len(payload); {
+	case l < 126:
+		frame = append(frame, maskBit|byte(l))
+	case l <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[len(frame)-2:], uint16(l))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(l))
+	}
+
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readWebsocketFrame reads a single frame from r, and unmasks its payload.
+func readWebsocketFrame(r io.Reader) (fin bool, opcode byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	fin = hdr[0]&0x80 != 0
+	opcode = hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > websocketMaxMessage {
+		err = errors.New("websocket frame too long")
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(r, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
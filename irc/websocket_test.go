@@ -0,0 +1,169 @@
+package irc
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// websocketServer is the server side of a WebSocket connection.
+type websocketServer struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newWebsocketServer starts an HTTP server that accepts a single WebSocket
+// connection with one of the given subprotocols, and sends it to the returned
+// channel.
+func newWebsocketServer(t *testing.T, protocols ...string) (u *url.URL, conns <-chan websocketServer) {
+	ch := make(chan websocketServer, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/irc" {
+			http.NotFound(w, r)
+			return
+		}
+		var protocol string
+	Protocols:
+		for _, offered := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+			for _, p := range protocols {
+				if strings.TrimSpace(offered) == p {
+					protocol = p
+					break Protocols
+				}
+			}
+		}
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(sum[:]))
+		if protocol != "" {
+			w.Header().Set("Sec-WebSocket-Protocol", protocol)
+		}
+		w.WriteHeader(http.StatusSwitchingProtocols)
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ch <- websocketServer{conn: conn, r: rw.Reader}
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Scheme = "ws"
+	u.Path = "/irc"
+	return u, ch
+}
+
+// dialWebsocket connects to the WebSocket server at u.
+func dialWebsocket(t *testing.T, u *url.URL) *WebsocketConn {
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := WebsocketHandshake(conn, u)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func (srv websocketServer) send(opcode byte, fin bool, payload string) {
+	frame := websocketFrame(opcode, []byte(payload), nil)
+	if !fin {
+		frame[0] &^= 0x80
+	}
+	srv.conn.Write(frame)
+}
+
+func (srv websocketServer) expect(t *testing.T, opcode byte, payload string) {
+	t.Helper()
+	fin, op, actual, err := readWebsocketFrame(srv.r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fin || op != opcode || string(actual) != payload {
+		t.Errorf("expected frame %d %q, got %d %q (fin: %t)", opcode, payload, op, actual, fin)
+	}
+}
+
+func TestWebsocket(t *testing.T) {
+	u, conns := newWebsocketServer(t, WebsocketBinary, WebsocketText)
+	ws := dialWebsocket(t, u)
+	srv := <-conns
+	defer srv.conn.Close()
+
+	if ws.Protocol() != WebsocketBinary {
+		t.Errorf("expected the binary subprotocol to be preferred, got %q", ws.Protocol())
+	}
+	in, out, _ := WebsocketInOut(ws, FloodControl{})
+
+	srv.send(wsBinary, true, ":irc.example.org NOTICE * :hello")
+	if msg := <-in; msg.Command != "NOTICE" || msg.Params[1] != "hello" {
+		t.Errorf("unexpected message %q", msg.String())
+	}
+
+	// Fragmented messages, with a ping in between.
+	srv.send(wsBinary, false, "PING ")
+	srv.send(wsPing, true, "senpai")
+	srv.send(wsContinuation, true, "token")
+	srv.expect(t, wsPong, "senpai")
+	if msg := <-in; msg.Command != "PING" || msg.Params[0] != "token" {
+		t.Errorf("unexpected message %q", msg.String())
+	}
+
+	out <- NewMessage("PONG", "token")
+	srv.expect(t, wsBinary, "PONG token")
+
+	close(out)
+	srv.expect(t, wsClose, "\x03\xe8")
+	if _, ok := <-in; ok {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestWebsocketText(t *testing.T) {
+	u, conns := newWebsocketServer(t, WebsocketText)
+	ws := dialWebsocket(t, u)
+	srv := <-conns
+	defer srv.conn.Close()
+
+	if ws.Protocol() != WebsocketText {
+		t.Errorf("expected the text subprotocol, got %q", ws.Protocol())
+	}
+	in, out, _ := WebsocketInOut(ws, FloodControl{})
+
+	out <- NewMessage("PRIVMSG", "#senpai", "caf\xe9")
+	srv.expect(t, wsText, "PRIVMSG #senpai caf\uFFFD")
+
+	srv.send(wsClose, true, "\x03\xe8")
+	srv.expect(t, wsClose, "\x03\xe8")
+	if _, ok := <-in; ok {
+		t.Error("expected the connection to be closed")
+	}
+	close(out)
+}
+
+func TestWebsocketHandshakeFailure(t *testing.T) {
+	u, _ := newWebsocketServer(t, WebsocketText)
+	u.Path = "/notfound"
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := WebsocketHandshake(conn, u); err == nil {
+		t.Error("expected the handshake to fail")
+	}
+}
@@ -0,0 +1,176 @@
+package senpai
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	// minReconnectDelay and maxReconnectDelay bound the time waited
+	// between two connection attempts.
+	minReconnectDelay = 2 * time.Second
+	maxReconnectDelay = 10 * time.Minute
+
+	// stableConnection is how long a connection must last for the delay
+	// before the next reconnection to start from minReconnectDelay again,
+	// that is to be between 1 and 2 seconds.
+	stableConnection = 2 * time.Minute
+)
+
+// backoff computes exponentially increasing delays with jitter.
+type backoff struct {
+	min, max time.Duration
+	attempts int
+	rand     *rand.Rand
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{
+		min:  min,
+		max:  max,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next returns the delay to wait before the next attempt: between half and
+// all of min*2^n, n being the number of previous attempts, capped to max.
+func (b *backoff) Next() time.Duration {
+	d := b.max
+	if b.attempts < 32 && b.min<<b.attempts < b.max {
+		d = b.min << b.attempts
+	}
+	b.attempts++
+	return d/2 + time.Duration(b.rand.Int63n(int64(d/2)+1))
+}
+
+// Reset makes the next delay start from min again.
+func (b *backoff) Reset() {
+	b.attempts = 0
+}
+
+// netStatus is the state of the connection to a network.
+type netStatus int
+
+const (
+	netConnecting netStatus = iota
+	netRegistering
+	netConnected
+	netWaiting
+	netDisconnected
+)
+
+// netState is sent by ircLoop whenever the state of the connection changes.
+type netState struct {
+	status netStatus
+	until  time.Time // when the next attempt is made, if waiting.
+}
+
+// String returns a short description of the state, or "" if connected.
+func (st netState) String() string {
+	switch st.status {
+	case netConnecting:
+		return "connecting"
+	case netRegistering:
+		return "registering"
+	case netWaiting:
+		// Minutes are enough for long waits, and change less often.
+		left := time.Until(st.until).Round(time.Second)
+		if time.Minute <= left {
+			return fmt.Sprintf("waiting %dm", (left+time.Minute-time.Second)/time.Minute)
+		}
+		return fmt.Sprintf("waiting %ds", left/time.Second)
+	case netDisconnected:
+		return "disconnected"
+	default:
+		return ""
+	}
+}
+
+// netControl is sent to ircLoop by the /reconnect and /disconnect commands.
+type netControl int
+
+const (
+	netReconnect netControl = iota
+	netDisconnect
+)
+
+// controlNetwork sends c to the ircLoop of netID, replacing any control that
+// it has not handled yet.
+func (app *App) controlNetwork(netID string, c netControl) {
+	ctrl, ok := app.controls[netID]
+	if !ok {
+		return
+	}
+	select {
+	case <-ctrl:
+	default:
+	}
+	ctrl <- c
+}
+
+// closeSession sends QUIT with the given reason and closes the session of
+// netID, if any.  ircLoop then sees the connection end.
+func (app *App) closeSession(netID, reason string) {
+	s, ok := app.sessions[netID]
+	if !ok {
+		return
+	}
+	s.Quit(reason)
+	s.Close()
+	delete(app.sessions, netID)
+	delete(app.connections, netID)
+}
+
+func (app *App) sendNetState(netID string, st netState) {
+	app.events <- event{
+		src:     netID,
+		content: st,
+	}
+}
+
+// setNetState updates the state of netID shown in the interface.
+func (app *App) setNetState(netID string, st netState) {
+	app.netStates[netID] = st
+	app.win.SetNetworkStatus(netID, st.String())
+}
+
+// waitReconnect blocks until the next connection attempt to netID, that is
+// after d, or immediately after a /reconnect.  After a /disconnect, it waits
+// for a /reconnect.
+func (app *App) waitReconnect(netID string, ctrl <-chan netControl, d time.Duration, disconnected bool) {
+	until := time.Now().Add(d)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	expired := timer.C
+	waiting := netState{status: netWaiting, until: until}
+	shown := waiting.String() // the countdown shown.
+	if disconnected {
+		expired = nil
+		app.sendNetState(netID, netState{status: netDisconnected})
+	} else {
+		app.sendNetState(netID, waiting)
+	}
+	for !app.win.ShouldExit() {
+		select {
+		case <-expired:
+			return
+		case <-ticker.C:
+			if expired != nil && waiting.String() != shown {
+				// Refresh the countdown.
+				shown = waiting.String()
+				app.sendNetState(netID, waiting)
+			}
+		case c := <-ctrl:
+			switch c {
+			case netReconnect:
+				return
+			case netDisconnect:
+				expired = nil
+				app.sendNetState(netID, netState{status: netDisconnected})
+			}
+		}
+	}
+}
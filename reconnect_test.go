@@ -0,0 +1,44 @@
+package senpai
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(2*time.Second, time.Minute)
+	expected := []time.Duration{
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		16 * time.Second,
+		32 * time.Second,
+		time.Minute,
+		time.Minute,
+	}
+	for i, max := range expected {
+		d := b.Next()
+		if d < max/2 || max < d {
+			t.Errorf("attempt %d: expected a delay between %s and %s, got %s", i, max/2, max, d)
+		}
+	}
+
+	b.Reset()
+	if d := b.Next(); d < time.Second || 2*time.Second < d {
+		t.Errorf("expected the delay to be reset, got %s", d)
+	}
+}
+
+func TestNetStateString(t *testing.T) {
+	st := netState{status: netWaiting, until: time.Now().Add(30 * time.Second)}
+	if s := st.String(); s != "waiting 30s" {
+		t.Errorf("expected %q, got %q", "waiting 30s", s)
+	}
+	st.until = time.Now().Add(4*time.Minute + 30*time.Second)
+	if s := st.String(); s != "waiting 5m" {
+		t.Errorf("expected %q, got %q", "waiting 5m", s)
+	}
+	if s := (netState{status: netConnected}).String(); s != "" {
+		t.Errorf("expected no state when connected, got %q", s)
+	}
+}
@@ -0,0 +1,115 @@
+package senpai
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~taiite/senpai/irc"
+	"git.sr.ht/~taiite/senpai/ui"
+)
+
+// STSPolicy is a Strict Transport Security policy, which tells to only
+// connect to a host with TLS.
+//
+// ref: https://ircv3.net/specs/extensions/sts
+type STSPolicy struct {
+	Port   int       // the port to connect to with TLS.
+	Expiry time.Time // when the policy ends, or zero until it is confirmed.
+}
+
+// STSPolicies returns the STS policies to persist, by host.
+func (app *App) STSPolicies() map[string]STSPolicy {
+	app.stsLock.Lock()
+	defer app.stsLock.Unlock()
+
+	now := time.Now()
+	policies := map[string]STSPolicy{}
+	for host, policy := range app.stsPolicies {
+		if policy.Expiry.After(now) {
+			policies[host] = policy
+		}
+	}
+	return policies
+}
+
+// SetSTSPolicies sets the STS policies that were persisted by a previous run.
+func (app *App) SetSTSPolicies(policies map[string]STSPolicy) {
+	app.stsLock.Lock()
+	defer app.stsLock.Unlock()
+
+	for host, policy := range policies {
+		app.stsPolicies[strings.ToLower(host)] = policy
+	}
+}
+
+func (app *App) setSTSPolicy(host string, policy STSPolicy) {
+	app.stsLock.Lock()
+	defer app.stsLock.Unlock()
+
+	app.stsPolicies[strings.ToLower(host)] = policy
+}
+
+func (app *App) removeSTSPolicy(host string) {
+	app.stsLock.Lock()
+	defer app.stsLock.Unlock()
+
+	delete(app.stsPolicies, strings.ToLower(host))
+}
+
+// stsUpgrade returns n with TLS enabled, if a STS policy applies to its host.
+func (app *App) stsUpgrade(n NetworkConfig) NetworkConfig {
+	if _, ok := n.websocketURL(); n.TLS || ok {
+		return n
+	}
+	host, _, _ := net.SplitHostPort(address(n))
+
+	app.stsLock.Lock()
+	policy, ok := app.stsPolicies[strings.ToLower(host)]
+	app.stsLock.Unlock()
+
+	if !ok || (!policy.Expiry.IsZero() && policy.Expiry.Before(time.Now())) {
+		return n
+	}
+	n.TLS = true
+	n.Addr = net.JoinHostPort(host, strconv.Itoa(policy.Port))
+	return n
+}
+
+// handleSTS applies the STS policy advertised through the connection of
+// netID.
+func (app *App) handleSTS(netID string, policy irc.STSPolicy) {
+	c, ok := app.connections[netID]
+	if !ok || c.websocket {
+		// STS only applies to IRC over TCP; the scheme of WebSocket
+		// addresses decides whether TLS is used.
+		return
+	}
+	if !c.tls {
+		if policy.Port == 0 {
+			return
+		}
+		app.setSTSPolicy(c.host, STSPolicy{Port: policy.Port})
+		app.addStatusLine(netID, ui.Line{
+			At:   time.Now(),
+			Head: "--",
+			Body: ui.PlainSprintf("The server requires TLS, reconnecting to port %d...", policy.Port),
+		})
+		c.conn.Close()
+		app.controlNetwork(netID, netReconnect)
+		return
+	}
+	if c.insecure || !policy.HasDuration {
+		// Policies must only be trusted from verified connections.
+		return
+	}
+	if policy.Duration == 0 {
+		app.removeSTSPolicy(c.host)
+		return
+	}
+	app.setSTSPolicy(c.host, STSPolicy{
+		Port:   c.port,
+		Expiry: time.Now().Add(policy.Duration),
+	})
+}
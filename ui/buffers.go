@@ -6,6 +6,8 @@ import (
 	"strings"
 	"time"
 
+	"git.sr.ht/~taiite/senpai/irc"
+
 	"github.com/gdamore/tcell/v2"
 )
 
@@ -28,22 +30,93 @@ const (
 
 type Line struct {
 	At        time.Time
+	ID        string // the msgid of the message shown, if any.
 	Head      string
 	Body      StyledString
 	HeadColor tcell.Color
 	Highlight bool
 	Mergeable bool
 	Data      []interface{}
+	ReplyTo   string // the ID of the line this one replies to, if any.
 
+	bodyStart   int        // index in Body after the quote of ReplyTo.
+	reactions   []reaction // reactions to this line, shown under it.
 	splitPoints []point
 	width       int
 	newLines    []int
 }
 
+// reaction is a reaction to a line, with the users who sent it.
+type reaction struct {
+	text  string
+	users []string
+}
+
+// quoteWidth is the width of the quote of a line, shown before the lines
+// replying to it.
+const quoteWidth = 32
+
 func (l *Line) IsZero() bool {
 	return l.Body.string == ""
 }
 
+// height returns the number of rows taken by the line in the timeline,
+// including the row of its reactions.
+func (l *Line) height(width int) int {
+	h := len(l.NewLines(width)) + 1
+	if len(l.reactions) != 0 {
+		h++
+	}
+	return h
+}
+
+// reactionsString returns the text of the row shown under the line, with each
+// reaction followed by the number of users who sent it.
+func (l *Line) reactionsString() string {
+	var sb strings.Builder
+	for i, r := range l.reactions {
+		if i != 0 {
+			sb.WriteString("  ")
+		}
+		fmt.Fprintf(&sb, "%s %d", r.text, len(r.users))
+	}
+	return sb.String()
+}
+
+// quoteReply prefixes the body of line with a short quote of the line it
+// replies to, looked up in lines.
+func quoteReply(lines []Line, line *Line) {
+	if line.ReplyTo == "" {
+		return
+	}
+	quote := "an earlier message"
+	for i := len(lines) - 1; 0 <= i; i-- {
+		parent := &lines[i]
+		if parent.ID == line.ReplyTo {
+			// The head is not the author of actions and notices.
+			author := parent.Head
+			if len(parent.Data) != 0 {
+				if ev, ok := parent.Data[0].(irc.MessageEvent); ok {
+					author = ev.User
+				}
+			}
+			body := strings.TrimSpace(parent.Body.string[parent.bodyStart:])
+			quote = author + ": " + truncate(body, quoteWidth, "\u2026")
+			break
+		}
+	}
+
+	var sb StyledStringBuilder
+	sb.SetStyle(tcell.StyleDefault.Foreground(tcell.ColorGray))
+	sb.WriteString("\u21aa ")
+	sb.WriteString(quote)
+	sb.SetStyle(tcell.StyleDefault)
+	sb.WriteString("  ")
+	line.bodyStart = sb.Len()
+	sb.WriteStyledString(line.Body)
+	line.Body = sb.StyledString()
+}
+
 func (l *Line) computeSplitPoints() {
 	if l.splitPoints == nil {
 		l.splitPoints = []point{}
@@ -185,6 +258,9 @@ type buffer struct {
 
 	lines []Line
 	topic string
+	modes string // channel modes, shown before the topic.
+
+	status string // shown after the title, or after netName for the network buffer.
 
 	scrollAmt int
 	isAtTop   bool
@@ -320,6 +396,7 @@ func (bs *BufferList) AddLine(netID, title string, notify NotifyType, line Line)
 	line.At = line.At.UTC()
 
 	if !line.Mergeable {
+		quoteReply(b.lines, &line)
 		line.Body = line.Body.ParseURLs()
 	}
 
@@ -333,7 +410,7 @@ func (bs *BufferList) AddLine(netID, title string, notify NotifyType, line Line)
 		line.computeSplitPoints()
 		b.lines = append(b.lines, line)
 		if idx == bs.current && 0 < b.scrollAmt {
-			b.scrollAmt += len(line.NewLines(bs.tlInnerWidth)) + 1
+			b.scrollAmt += line.height(bs.tlInnerWidth)
 		}
 	}
 
@@ -363,6 +440,7 @@ func (bs *BufferList) AddLines(netID, title string, before, after []Line) {
 				}
 			} else {
 				if buf != &b.lines {
+					quoteReply(lines, &line)
 					line.Body = line.Body.ParseURLs()
 					line.computeSplitPoints()
 				}
@@ -373,6 +451,120 @@ func (bs *BufferList) AddLines(netID, title string, before, after []Line) {
 	b.lines = lines
 }
 
+// InsertLines adds lines where they belong in time among the lines of the
+// buffer, such as messages missing from its history.
+func (bs *BufferList) InsertLines(netID, title string, lines []Line) {
+	idx := bs.idx(netID, title)
+	if idx < 0 {
+		return
+	}
+
+	b := &bs.list[idx]
+	for _, line := range lines {
+		i := len(b.lines)
+		for 0 < i && line.At.Before(b.lines[i-1].At) {
+			i--
+		}
+		quoteReply(b.lines[:i], &line)
+		line.Body = line.Body.ParseURLs()
+		line.computeSplitPoints()
+		b.lines = append(b.lines, Line{})
+		copy(b.lines[i+1:], b.lines[i:])
+		b.lines[i] = line
+
+		if idx == bs.current && 0 < b.scrollAmt {
+			// Keep the view in place if the line is below it.
+			below := 0
+			for _, l := range b.lines[i+1:] {
+				below += l.height(bs.tlInnerWidth)
+			}
+			if below < b.scrollAmt {
+				b.scrollAmt += line.height(bs.tlInnerWidth)
+			}
+		}
+	}
+}
+
+// AddReaction adds the reaction of user to the line whose ID is id, if it is in
+// the buffer.  It reports whether the line has been found.
+func (bs *BufferList) AddReaction(netID, title, id, user, text string) bool {
+	idx := bs.idx(netID, title)
+	if idx < 0 || id == "" {
+		return false
+	}
+
+	b := &bs.list[idx]
+	for i := len(b.lines) - 1; 0 <= i; i-- {
+		line := &b.lines[i]
+		if line.ID != id {
+			continue
+		}
+		if len(line.reactions) == 0 && idx == bs.current && 0 < b.scrollAmt {
+			b.scrollAmt++
+		}
+		for j := range line.reactions {
+			r := &line.reactions[j]
+			if r.text != text {
+				continue
+			}
+			for _, u := range r.users {
+				if u == user {
+					return true
+				}
+			}
+			r.users = append(r.users, user)
+			return true
+		}
+		line.reactions = append(line.reactions, reaction{
+			text:  text,
+			users: []string{user},
+		})
+		return true
+	}
+	return false
+}
+
+// RedactLine replaces the body of the line whose ID is id, if it is in the
+// buffer, and removes its reactions and data.  It reports whether the line has
+// been found.
+func (bs *BufferList) RedactLine(netID, title, id string, body StyledString) bool {
+	idx := bs.idx(netID, title)
+	if idx < 0 || id == "" {
+		return false
+	}
+
+	b := &bs.list[idx]
+	for i := len(b.lines) - 1; 0 <= i; i-- {
+		line := &b.lines[i]
+		if line.ID != id {
+			continue
+		}
+		line.Body = body
+		line.Data = nil
+		line.bodyStart = 0
+		line.reactions = nil
+		line.width = 0
+		line.computeSplitPoints()
+		return true
+	}
+	return false
+}
+
+// FindLine returns the last line of the buffer for which match returns true.
+func (bs *BufferList) FindLine(netID, title string, match func(*Line) bool) (line Line, ok bool) {
+	idx := bs.idx(netID, title)
+	if idx < 0 {
+		return line, false
+	}
+	b := &bs.list[idx]
+	for i := len(b.lines) - 1; 0 <= i; i-- {
+		if match(&b.lines[i]) {
+			return b.lines[i], true
+		}
+	}
+	return line, false
+}
+
 func (bs *BufferList) SetTopic(netID, title string, topic string) {
 	idx := bs.idx(netID, title)
 	if idx < 0 {
@@ -382,6 +574,23 @@ func (bs *BufferList) SetTopic(netID, title string, topic string) {
 	b.topic = topic
 }
 
+func (bs *BufferList) SetModes(netID, title string, modes string) {
+	idx := bs.idx(netID, title)
+	if idx < 0 {
+		return
+	}
+	b := &bs.list[idx]
+	b.modes = modes
+}
+
+func (bs *BufferList) SetStatus(netID, title, status string) {
+	idx := bs.idx(netID, title)
+	if idx < 0 {
+		return
+	}
+	bs.list[idx].status = status
+}
+
 func (bs *BufferList) Current() (netID, title string) {
 	b := &bs.list[bs.current]
 	return b.netID, b.title
@@ -414,7 +623,7 @@ func (bs *BufferList) ScrollUpHighlight() bool {
 			b.scrollAmt = y - bs.tlHeight + 1
 			return true
 		}
-		y += len(line.NewLines(bs.tlInnerWidth)) + 1
+		y += line.height(bs.tlInnerWidth)
 	}
 	return false
 }
@@ -428,7 +637,7 @@ func (bs *BufferList) ScrollDownHighlight() bool {
 		if line.Highlight {
 			yLastHighlight = y
 		}
-		y += len(line.NewLines(bs.tlInnerWidth)) + 1
+		y += line.height(bs.tlInnerWidth)
 	}
 	b.scrollAmt = yLastHighlight
 	return b.scrollAmt != 0
@@ -493,6 +702,10 @@ func (bs *BufferList) DrawVerticalBufferList(screen tcell.Screen, x0, y0, width,
 		}
 		title = truncate(title, width-(x-x0), "\u2026")
 		printString(screen, &x, y, Styled(title, st))
+		if b.status != "" && x+1 < x0+width {
+			status := truncate(" ("+b.status+")", x0+width-x, "\u2026")
+			printString(screen, &x, y, Styled(status, st.Foreground(tcell.ColorGray)))
+		}
 
 		if bi == bs.current || bi == bs.clicked {
 			st := tcell.StyleDefault.Reverse(true)
@@ -535,6 +748,9 @@ func (bs *BufferList) DrawHorizontalBufferList(screen tcell.Screen, x0, y0, widt
 		} else {
 			title = b.title
 		}
+		if b.status != "" {
+			title += " (" + b.status + ")"
+		}
 		title = truncate(title, width-x, "\u2026")
 		printString(screen, &x, y0, Styled(title, st))
 
@@ -561,6 +777,9 @@ func (bs *BufferList) DrawTimeline(screen tcell.Screen, x0, y0, nickColWidth int
 	b := &bs.list[bs.current]
 
 	xTopic := x0
+	if b.modes != "" {
+		printString(screen, &xTopic, y0, Styled("["+b.modes+"] ", tcell.StyleDefault.Foreground(tcell.ColorGray)))
+	}
 	printString(screen, &xTopic, y0, Styled(b.topic, tcell.StyleDefault))
 	y0++
 	for x := x0; x < x0+bs.tlInnerWidth+nickColWidth+9; x++ {
@@ -579,11 +798,21 @@ func (bs *BufferList) DrawTimeline(screen tcell.Screen, x0, y0, nickColWidth int
 
 		line := &b.lines[i]
 		nls := line.NewLines(bs.tlInnerWidth)
-		yi -= len(nls) + 1
+		yi -= line.height(bs.tlInnerWidth)
 		if y0+bs.tlHeight <= yi {
 			continue
 		}
 
+		if len(line.reactions) != 0 {
+			yr := yi + len(nls) + 1
+			if y0 <= yr && yr < y0+bs.tlHeight {
+				x := x1
+				st := tcell.StyleDefault.Foreground(tcell.ColorGray)
+				text := truncate(line.reactionsString(), bs.tlInnerWidth, "\u2026")
+				printString(screen, &x, yr, Styled(text, st))
+			}
+		}
+
 		if yi >= y0 {
 			if i == 0 || b.lines[i-1].At.Truncate(time.Minute) != line.At.Truncate(time.Minute) {
 				st := tcell.StyleDefault.Bold(true)
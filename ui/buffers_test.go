@@ -3,6 +3,9 @@ package ui
 import (
 	"strings"
 	"testing"
+	"time"
+
+	"git.sr.ht/~taiite/senpai/irc"
 )
 
 func assertSplitPoints(t *testing.T, body string, expected []point) {
@@ -142,3 +145,135 @@ func TestRenderedHeight(t *testing.T) {
 
 	assertNewLines(t, "cc en direct du word wrapping des familles le tests ça v a va va v a va", 46, 2)
 }
+
+func TestRepliesAndReactions(t *testing.T) {
+	bs := NewBufferList(nil)
+	bs.Add("net", "", "#senpai")
+	bs.AddLine("net", "#senpai", NotifyNone, Line{
+		ID:   "a",
+		Head: "kouhai",
+		Body: PlainString("hello world"),
+	})
+	bs.AddLine("net", "#senpai", NotifyNone, Line{
+		ID:      "b",
+		Head:    "senpai",
+		Body:    PlainString("hi"),
+		ReplyTo: "a",
+	})
+	bs.AddLines("net", "#senpai", nil, []Line{{
+		Head:    "kouhai",
+		Body:    PlainString("sure"),
+		ReplyTo: "b",
+	}, {
+		ID:   "c",
+		Head: "*",
+		Body: PlainString("sensei waves"),
+		Data: []interface{}{irc.MessageEvent{User: "sensei"}},
+	}, {
+		Head:    "senpai",
+		Body:    PlainString("hey"),
+		ReplyTo: "c",
+	}})
+
+	lines := bs.list[0].lines
+	for i, expected := range []string{
+		"hello world",
+		"↪ kouhai: hello world  hi",
+		"↪ senpai: hi  sure",
+		"sensei waves",
+		"↪ sensei: sensei waves  hey",
+	} {
+		if lines[i].Body.String() != expected {
+			t.Errorf("expected line %d to be %q, got %q", i, expected, lines[i].Body.String())
+		}
+	}
+
+	bs.AddReaction("net", "#senpai", "a", "senpai", "\U0001f44d")
+	bs.AddReaction("net", "#senpai", "a", "senpai", "\U0001f44d")
+	bs.AddReaction("net", "#senpai", "a", "sensei", "\U0001f44d")
+	bs.AddReaction("net", "#senpai", "a", "sensei", "\U0001f440")
+	if bs.AddReaction("net", "#senpai", "z", "sensei", "\U0001f440") {
+		t.Errorf("expected no line to be found for a reaction to an unknown message")
+	}
+
+	line := &bs.list[0].lines[0]
+	if s := line.reactionsString(); s != "\U0001f44d 2  \U0001f440 1" {
+		t.Errorf("expected reactions to be aggregated, got %q", s)
+	}
+	if h := line.height(80); h != 2 {
+		t.Errorf("expected a line with reactions to take 2 rows, takes %d", h)
+	}
+}
+
+func TestInsertLines(t *testing.T) {
+	t0 := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	bs := NewBufferList(nil)
+	bs.Add("net", "", "#senpai")
+	for i, body := range []string{"a", "c", "e"} {
+		bs.AddLine("net", "#senpai", NotifyNone, Line{
+			At:   t0.Add(time.Duration(2*i) * time.Second),
+			Body: PlainString(body),
+		})
+	}
+	bs.InsertLines("net", "#senpai", []Line{
+		{At: t0.Add(1 * time.Second), Body: PlainString("b")},
+		{At: t0.Add(3 * time.Second), Body: PlainString("d")},
+		{At: t0.Add(9 * time.Second), Body: PlainString("f")},
+	})
+
+	lines := bs.list[0].lines
+	if len(lines) != 6 {
+		t.Fatalf("expected 6 lines, got %d", len(lines))
+	}
+	for i, expected := range []string{"a", "b", "c", "d", "e", "f"} {
+		if lines[i].Body.String() != expected {
+			t.Errorf("expected line %d to be %q, got %q", i, expected, lines[i].Body.String())
+		}
+	}
+}
+
+func TestInsertLinesScrolled(t *testing.T) {
+	t0 := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	bs := NewBufferList(nil)
+	bs.Add("net", "", "#senpai")
+	bs.ResizeTimeline(80, 10)
+	for i := 0; i < 20; i++ {
+		bs.AddLine("net", "#senpai", NotifyNone, Line{
+			At:   t0.Add(time.Duration(2*i) * time.Second),
+			Body: PlainString("hello"),
+		})
+	}
+	bs.ScrollUp(3)
+
+	// Lines below the view keep it in place, others do not move it.
+	bs.InsertLines("net", "#senpai", []Line{{At: t0.Add(37 * time.Second), Body: PlainString("below")}})
+	if bs.list[0].scrollAmt != 4 {
+		t.Errorf("expected to scroll by the inserted line, got %d", bs.list[0].scrollAmt)
+	}
+	bs.InsertLines("net", "#senpai", []Line{{At: t0.Add(time.Second), Body: PlainString("above")}})
+	if bs.list[0].scrollAmt != 4 {
+		t.Errorf("expected not to scroll, got %d", bs.list[0].scrollAmt)
+	}
+}
+
+func TestRedactLine(t *testing.T) {
+	bs := NewBufferList(nil)
+	bs.Add("net", "", "#senpai")
+	bs.AddLine("net", "#senpai", NotifyNone, Line{
+		ID:   "a",
+		Head: "kouhai",
+		Body: PlainString("a secret"),
+	})
+	bs.AddReaction("net", "#senpai", "a", "senpai", "\U0001f440")
+
+	if !bs.RedactLine("net", "#senpai", "a", PlainString("message deleted")) {
+		t.Fatalf("expected the line to be found")
+	}
+	line := &bs.list[0].lines[0]
+	if line.Body.String() != "message deleted" || line.Head != "kouhai" {
+		t.Errorf("expected the body to be replaced, got %q: %q", line.Head, line.Body.String())
+	}
+	if h := line.height(80); h != 1 {
+		t.Errorf("expected the reactions to be removed, the line takes %d rows", h)
+	}
+}
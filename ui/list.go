@@ -0,0 +1,234 @@
+package ui
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ListRow is a row of a List.
+type ListRow struct {
+	Key    string   // identifies the row, such as a ban mask.
+	Cells  []string // one per column.
+	Marked bool
+}
+
+// List is a table shown in place of the timeline, such as the ban list of a
+// channel.  Rows can be selected, marked, sorted and searched.
+type List struct {
+	title   string
+	help    string // shown after the title.
+	columns []string
+	rows    []ListRow
+
+	search     string // only rows with a cell containing it are shown.
+	sortColumn int    // the column rows are sorted by, or -1.
+	shown      []int  // indexes of the rows shown, in order.
+
+	selected int // index in shown.
+	offset   int // index in shown of the first row on screen.
+}
+
+func NewList(title, help string, columns []string, rows []ListRow) *List {
+	l := &List{
+		title:      title,
+		help:       help,
+		columns:    columns,
+		rows:       rows,
+		sortColumn: -1,
+	}
+	l.update()
+	return l
+}
+
+func (l *List) SetTitle(title string) {
+	l.title = title
+}
+
+// Len returns the number of rows, shown or not.
+func (l *List) Len() int {
+	return len(l.rows)
+}
+
+// AddRows adds rows at the end of the list, or where they belong if the list
+// is sorted.
+func (l *List) AddRows(rows ...ListRow) {
+	l.rows = append(l.rows, rows...)
+	l.update()
+}
+
+// Search only shows the rows that have a cell containing search, regardless
+// of case.
+func (l *List) Search(search string) {
+	l.search = strings.ToLower(search)
+	l.selected = 0
+	l.update()
+}
+
+// SortNext sorts the rows by the next column, or by the first one if they are
+// sorted by the last one.  Numbers are sorted in decreasing order, and other
+// cells in alphabetical order.
+func (l *List) SortNext() {
+	l.sortColumn = (l.sortColumn + 1) % len(l.columns)
+	l.update()
+}
+
+// update sorts the rows and computes which are shown.
+func (l *List) update() {
+	if 0 <= l.sortColumn {
+		c := l.sortColumn
+		cell := func(i int) string {
+			if c < len(l.rows[i].Cells) {
+				return l.rows[i].Cells[c]
+			}
+			return ""
+		}
+		sort.SliceStable(l.rows, func(i, j int) bool {
+			a, b := cell(i), cell(j)
+			na, errA := strconv.Atoi(a)
+			nb, errB := strconv.Atoi(b)
+			if errA == nil && errB == nil {
+				return na > nb
+			}
+			return strings.ToLower(a) < strings.ToLower(b)
+		})
+	}
+	l.shown = l.shown[:0]
+	for i, row := range l.rows {
+		if l.search == "" {
+			l.shown = append(l.shown, i)
+			continue
+		}
+		for _, cell := range row.Cells {
+			if strings.Contains(strings.ToLower(cell), l.search) {
+				l.shown = append(l.shown, i)
+				break
+			}
+		}
+	}
+	l.Move(0)
+}
+
+// Move moves the selection by n rows, down if n is positive.
+func (l *List) Move(n int) {
+	l.selected += n
+	if len(l.shown) <= l.selected {
+		l.selected = len(l.shown) - 1
+	}
+	if l.selected < 0 {
+		l.selected = 0
+	}
+}
+
+// Selected returns the selected row, if any.
+func (l *List) Selected() (row ListRow, ok bool) {
+	if l.selected < len(l.shown) {
+		return l.rows[l.shown[l.selected]], true
+	}
+	return ListRow{}, false
+}
+
+// ToggleMark marks the selected row, or unmarks it if it is marked.
+func (l *List) ToggleMark() {
+	if l.selected < len(l.shown) {
+		row := &l.rows[l.shown[l.selected]]
+		row.Marked = !row.Marked
+	}
+}
+
+// TakeMarked removes the marked rows from the list and returns them.
+func (l *List) TakeMarked() (marked []ListRow) {
+	rows := l.rows[:0]
+	for _, row := range l.rows {
+		if row.Marked {
+			marked = append(marked, row)
+		} else {
+			rows = append(rows, row)
+		}
+	}
+	l.rows = rows
+	l.update()
+	return marked
+}
+
+func (l *List) Draw(screen tcell.Screen, x0, y0, width, height int) {
+	clearArea(screen, x0, y0, width, height)
+
+	x := x0
+	printString(screen, &x, y0, Styled(l.title, tcell.StyleDefault.Bold(true)))
+	x++
+	if l.search != "" {
+		printString(screen, &x, y0, Styled("/"+l.search+"/", tcell.StyleDefault.Foreground(tcell.ColorYellow)))
+		x++
+	}
+	printString(screen, &x, y0, Styled(truncate(l.help, x0+width-x, "…"), tcell.StyleDefault.Foreground(tcell.ColorGray)))
+	y0++
+	for x := x0; x < x0+width; x++ {
+		screen.SetContent(x, y0, 0x2500, nil, tcell.StyleDefault.Foreground(tcell.ColorGray))
+	}
+	y0++
+	height -= 2
+
+	// Every column but the last one is as wide as its widest cell, up to a
+	// third of the screen.  The last one takes the remaining space.
+	widths := make([]int, len(l.columns))
+	for i, column := range l.columns[:len(l.columns)-1] {
+		widths[i] = stringWidth(column)
+		for _, row := range l.rows {
+			if i < len(row.Cells) && widths[i] < stringWidth(row.Cells[i]) {
+				widths[i] = stringWidth(row.Cells[i])
+			}
+		}
+		if width/3 < widths[i] {
+			widths[i] = width / 3
+		}
+	}
+
+	drawRow := func(y int, cells []string, st tcell.Style) {
+		x := x0 + 2
+		for i, cell := range cells {
+			if len(widths) <= i {
+				break
+			}
+			w := widths[i]
+			if i == len(widths)-1 {
+				w = x0 + width - x
+			}
+			xCell := x
+			printString(screen, &xCell, y, Styled(truncate(cell, w, "…"), st))
+			x += w + 2
+		}
+	}
+	headers := make([]string, len(l.columns))
+	copy(headers, l.columns)
+	if 0 <= l.sortColumn {
+		headers[l.sortColumn] += " ▾"
+	}
+	drawRow(y0, headers, tcell.StyleDefault.Underline(true))
+	y0++
+	height--
+
+	if l.selected < l.offset {
+		l.offset = l.selected
+	} else if l.offset+height <= l.selected {
+		l.offset = l.selected - height + 1
+	}
+	for i := l.offset; i < len(l.shown) && i-l.offset < height; i++ {
+		row := l.rows[l.shown[i]]
+		y := y0 + i - l.offset
+		st := tcell.StyleDefault
+		if row.Marked {
+			st = st.Foreground(tcell.ColorRed)
+			screen.SetContent(x0, y, '-', nil, st)
+		}
+		if i == l.selected {
+			st = st.Reverse(true)
+			for x := x0 + 2; x < x0+width; x++ {
+				screen.SetContent(x, y, ' ', nil, st)
+			}
+		}
+		drawRow(y, row.Cells, st)
+	}
+}
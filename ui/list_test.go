@@ -0,0 +1,80 @@
+package ui
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListMarks(t *testing.T) {
+	l := NewList("Bans", "", []string{"Mask"}, []ListRow{
+		{Key: "a"},
+		{Key: "b"},
+		{Key: "c"},
+	})
+
+	l.Move(-1)
+	l.ToggleMark()
+	l.Move(5)
+	l.ToggleMark()
+	l.Move(-1)
+	l.ToggleMark()
+	l.ToggleMark()
+
+	marked := l.TakeMarked()
+	expected := []ListRow{{Key: "a", Marked: true}, {Key: "c", Marked: true}}
+	if !reflect.DeepEqual(marked, expected) {
+		t.Errorf("expected %#v to be marked, got %#v", expected, marked)
+	}
+	if row, ok := l.Selected(); !ok || row.Key != "b" {
+		t.Errorf("expected b to be left and selected, got %#v", row)
+	}
+}
+
+func TestListSearchAndSort(t *testing.T) {
+	l := NewList("Channels", "", []string{"Channel", "Users", "Topic"}, []ListRow{
+		{Key: "#go", Cells: []string{"#go", "8", "Gophers"}},
+		{Key: "#senpai", Cells: []string{"#senpai", "42", "IRC client"}},
+	})
+	l.AddRows(ListRow{Key: "#irc", Cells: []string{"#irc", "100", "All about IRC"}})
+
+	l.SortNext() // by channel
+	if row, _ := l.Selected(); row.Key != "#go" {
+		t.Errorf("expected #go first by name, got %q", row.Key)
+	}
+	l.SortNext() // by users, decreasing
+	if row, _ := l.Selected(); row.Key != "#irc" {
+		t.Errorf("expected #irc first by users, got %q", row.Key)
+	}
+
+	l.Search("irc")
+	l.Move(1)
+	if row, _ := l.Selected(); row.Key != "#senpai" {
+		t.Errorf("expected #senpai second when searching for irc, got %q", row.Key)
+	}
+	l.Move(1)
+	if row, _ := l.Selected(); row.Key != "#senpai" {
+		t.Errorf("expected #go not to be shown, got %q", row.Key)
+	}
+}
+
+func TestListClosedWithBuffer(t *testing.T) {
+	ui := &UI{bs: NewBufferList(nil)}
+	ui.bs.Add("net", "", "")
+	ui.bs.Add("net", "", "#senpai")
+	ui.bs.Add("other", "", "")
+	ui.bs.To(1)
+
+	l := NewList("Bans", "", []string{"Mask"}, nil)
+	ui.OpenList(l)
+	if ui.List() != l {
+		t.Fatalf("expected the list to be shown")
+	}
+	ui.bs.To(2)
+	if ui.List() != nil {
+		t.Errorf("expected the list to be closed once another buffer is shown")
+	}
+	ui.bs.To(1)
+	if ui.List() != nil {
+		t.Errorf("expected the list to stay closed")
+	}
+}
@@ -3,12 +3,16 @@ package ui
 import (
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"git.sr.ht/~taiite/senpai/irc"
 
 	"github.com/gdamore/tcell/v2"
 )
 
+// lagWarning is the lag from which it is shown in red.
+const lagWarning = 5 * time.Second
+
 type Config struct {
 	NickColWidth   int
 	ChanColWidth   int
@@ -26,8 +30,13 @@ type UI struct {
 
 	bs     BufferList
 	e      Editor
+	list   *List // shown in place of the timeline if not nil.
 	prompt StyledString
 	status string
+	lag    time.Duration
+
+	listNetID string // the buffer list is shown over.
+	listTitle string
 
 	channelOffset int
 	memberOffset  int
@@ -195,6 +204,22 @@ func (ui *UI) AddLines(netID, buffer string, before, after []Line) {
 	ui.bs.AddLines(netID, buffer, before, after)
 }
 
+func (ui *UI) InsertLines(netID, buffer string, lines []Line) {
+	ui.bs.InsertLines(netID, buffer, lines)
+}
+
+func (ui *UI) AddReaction(netID, buffer, id, user, reaction string) bool {
+	return ui.bs.AddReaction(netID, buffer, id, user, reaction)
+}
+
+func (ui *UI) RedactLine(netID, buffer, id string, body StyledString) bool {
+	return ui.bs.RedactLine(netID, buffer, id, body)
+}
+
+func (ui *UI) FindLine(netID, buffer string, match func(*Line) bool) (Line, bool) {
+	return ui.bs.FindLine(netID, buffer, match)
+}
+
 func (ui *UI) JumpBuffer(sub string) bool {
 	subLower := strings.ToLower(sub)
 	for i, b := range ui.bs.list {
@@ -236,10 +261,55 @@ func (ui *UI) SetTopic(netID, buffer string, topic string) {
 	ui.bs.SetTopic(netID, buffer, topic)
 }
 
+// OpenList shows list in place of the timeline of the current buffer, until
+// CloseList is called or another buffer is shown.
+func (ui *UI) OpenList(list *List) {
+	netID, title := ui.bs.Current()
+	ui.list = list
+	ui.listNetID = netID
+	ui.listTitle = title
+}
+
+func (ui *UI) CloseList() {
+	ui.list = nil
+}
+
+// List returns the list being shown, or nil.
+func (ui *UI) List() *List {
+	if ui.list != nil {
+		if netID, title := ui.bs.Current(); netID != ui.listNetID || title != ui.listTitle {
+			ui.list = nil
+		}
+	}
+	return ui.list
+}
+
+func (ui *UI) SetModes(netID, buffer string, modes string) {
+	ui.bs.SetModes(netID, buffer, modes)
+}
+
+// SetNetworkStatus sets the status shown next to the name of the network netID
+// in the buffer list, such as "connecting", or "" for none.
+func (ui *UI) SetNetworkStatus(netID, status string) {
+	ui.bs.SetStatus(netID, "", status)
+}
+
+// SetBufferStatus sets the status shown after the title of the given buffer,
+// or removes it if status is empty.
+func (ui *UI) SetBufferStatus(netID, buffer, status string) {
+	ui.bs.SetStatus(netID, buffer, status)
+}
+
 func (ui *UI) SetStatus(status string) {
 	ui.status = status
 }
 
+// SetLag sets the lag to the server shown on the right of the status bar, or 0
+// to hide it.
+func (ui *UI) SetLag(lag time.Duration) {
+	ui.lag = lag
+}
+
 func (ui *UI) SetPrompt(prompt StyledString) {
 	ui.prompt = prompt
 }
@@ -338,7 +408,11 @@ func (ui *UI) Draw(members []irc.Member) {
 		ui.e.Draw(ui.screen, 9+ui.config.ChanColWidth+ui.config.NickColWidth, h-1)
 	}
 
-	ui.bs.DrawTimeline(ui.screen, ui.config.ChanColWidth, 0, ui.config.NickColWidth)
+	if list := ui.List(); list != nil {
+		list.Draw(ui.screen, ui.config.ChanColWidth, 0, ui.bs.tlInnerWidth+ui.config.NickColWidth+9, ui.bs.tlHeight+2)
+	} else {
+		ui.bs.DrawTimeline(ui.screen, ui.config.ChanColWidth, 0, ui.config.NickColWidth)
+	}
 	if ui.config.ChanColWidth == 0 {
 		ui.bs.DrawHorizontalBufferList(ui.screen, 0, h-1, w-ui.config.MemberColWidth)
 	} else {
@@ -371,6 +445,20 @@ func (ui *UI) Draw(members []irc.Member) {
 func (ui *UI) drawStatusBar(x0, y, width int) {
 	clearArea(ui.screen, x0, y, width, 1)
 
+	if ui.lag != 0 {
+		lag := ui.lag.Round(100 * time.Millisecond)
+		if ui.lag < time.Second {
+			lag = ui.lag.Round(time.Millisecond)
+		}
+		text := "lag " + lag.String()
+		x := x0 + width - len(text) - 1
+		st := tcell.StyleDefault.Foreground(tcell.ColorGray)
+		if lagWarning <= ui.lag {
+			st = tcell.StyleDefault.Foreground(tcell.ColorRed)
+		}
+		printString(ui.screen, &x, y, Styled(text, st))
+	}
+
 	if ui.status == "" {
 		return
 	}
@@ -414,8 +502,21 @@ func drawVerticalMemberList(screen tcell.Screen, x0, y0, width, height int, memb
 			x++
 		}
 
+		// Identified members are followed by a check mark, and by their
+		// account if it differs from their nick.
+		var account string
+		if m.Account != "" {
+			account = " \u2713"
+			if !strings.EqualFold(m.Account, m.Name.Name) {
+				account += m.Account
+			}
+		}
+		if width-1 < stringWidth(m.Name.Name)+stringWidth(account) {
+			account = truncate(account, (width-1)/2, "\u2026")
+		}
+
 		var name StyledString
-		nameText := truncate(m.Name.Name, width-1, "\u2026")
+		nameText := truncate(m.Name.Name, width-1-stringWidth(account), "\u2026")
 		if m.Away {
 			name = Styled(nameText, tcell.StyleDefault.Foreground(tcell.ColorGray))
 		} else {
@@ -423,5 +524,6 @@ func drawVerticalMemberList(screen tcell.Screen, x0, y0, width, height int, memb
 		}
 
 		printString(screen, &x, y, name)
+		printString(screen, &x, y, Styled(account, tcell.StyleDefault.Foreground(tcell.ColorGray)))
 	}
 }
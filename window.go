@@ -50,8 +50,11 @@ func (app *App) setStatus() {
 	netID, buffer := app.win.CurrentBuffer()
 	s := app.sessions[netID]
 	if s == nil {
+		app.win.SetStatus("")
+		app.win.SetLag(0)
 		return
 	}
+	app.win.SetLag(s.Lag())
 	ts := s.Typings(buffer)
 	status := ""
 	if 3 < len(ts) {